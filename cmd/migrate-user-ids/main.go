@@ -0,0 +1,49 @@
+// Command migrate-user-ids rewrites orders, carts, idempotency keys and refresh
+// tokens that refer to users by email address so they use the user's uuid, the
+// identifier access tokens now carry.
+//
+//	go run ./cmd/migrate-user-ids -dry-run
+//	go run ./cmd/migrate-user-ids
+//
+// It reads MONGO_URI like the service and can be run again safely.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"foodie-service/database"
+	"foodie-service/models"
+	"os"
+	"strings"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing")
+	flag.Parse()
+
+	db, err := database.MongoClient("primary")
+	if err != nil {
+		fmt.Println("Connection to primary mongo instance could not be established", err)
+		os.Exit(1)
+	}
+
+	results, err := models.MigrateUserIDs(context.Background(), db, *dryRun)
+	for _, result := range results {
+		verb := "updated"
+		if *dryRun {
+			verb = "would update"
+		}
+		fmt.Printf("%s.%s: %d emails, %s %d documents\n", result.Collection, result.Field, result.Emails, verb, result.Updated)
+		if len(result.Unknown) > 0 {
+			fmt.Printf("  no user found for: %s\n", strings.Join(result.Unknown, ", "))
+		}
+		if len(result.Conflicts) > 0 {
+			fmt.Printf("  already migrated under uuid, left unchanged: %s\n", strings.Join(result.Conflicts, ", "))
+		}
+	}
+	if err != nil {
+		fmt.Println("Migration failed:", err)
+		os.Exit(1)
+	}
+}
@@ -2,13 +2,104 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// OIDCProvider is an OpenID Connect identity provider users can sign in with,
+// such as Google or Apple
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
 type Config struct {
 	JWTSecret string
-	MONGO_URI string
+	// JWTSigningKeyPath is a PEM encoded RSA or Ed25519 private key. When set,
+	// tokens are signed with it instead of JWTSecret.
+	JWTSigningKeyPath string
+	// JWTKeyID is the kid of the signing key. It defaults to a thumbprint of
+	// the key.
+	JWTKeyID string
+	// JWTVerificationKeys are extra kid=path public keys still accepted while
+	// rotating away from them
+	JWTVerificationKeys []string
+	// LegacyAPIKeyHeader is checked for a token when no Authorization header is
+	// sent. Empty disables the fallback.
+	LegacyAPIKeyHeader string
+	MONGO_URI          string
+	// AccessTokenTTL is how long a JWT access token is valid
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a refresh token can be used to obtain new
+	// access tokens
+	RefreshTokenTTL time.Duration
+	// OrderCancellationWindow is how long after placement a customer may
+	// cancel regardless of status. Zero disables the window.
+	OrderCancellationWindow time.Duration
+	// OrderCancelBeforeStatus is the first status at which a customer can no
+	// longer cancel once the window has passed
+	OrderCancelBeforeStatus string
+	// IdempotencyKeyTTL is how long an Idempotency-Key and its stored response
+	// are kept
+	IdempotencyKeyTTL time.Duration
+	// AdminEmails are given the admin role when they sign up
+	AdminEmails []string
+	// LoginMaxFailures is how many failed logins for one email lock it for
+	// LoginLockoutDuration
+	LoginMaxFailures int
+	// LoginMaxFailuresPerIP is how many failed logins from one IP, across all
+	// emails, lock that IP out
+	LoginMaxFailuresPerIP int
+	// LoginFailureWindow is how long a failed login counts towards a lockout
+	LoginFailureWindow   time.Duration
+	LoginLockoutDuration time.Duration
+	// LoginBackoffBase is the wait after the first failed login for an email.
+	// It doubles with each further failure.
+	LoginBackoffBase time.Duration
+	// PasswordResetTTL is how long a password reset token can be used
+	PasswordResetTTL time.Duration
+	// EmailVerificationTTL is how long the link sent on signup works
+	EmailVerificationTTL time.Duration
+	// RequireVerifiedEmailForOrders stops users who have not verified their
+	// email from placing orders
+	RequireVerifiedEmailForOrders bool
+	// PublicBaseURL is where this service is reachable, used to build links in
+	// emails
+	PublicBaseURL string
+	// Notifier selects how emails to users are delivered: "log" prints them,
+	// "file" appends them to NotifierFile
+	Notifier     string
+	NotifierFile string
+	// NotifierLogBodies makes the log notifier print message bodies, which
+	// contain live tokens. Only for local development.
+	NotifierLogBodies bool
+	// OIDCProviders are the identity providers enabled for social login
+	OIDCProviders []OIDCProvider
+	// OIDCStateTTL is how long a user has to finish signing in at the provider
+	OIDCStateTTL time.Duration
+	// ProxyHeader is the header a load balancer puts the client IP in. Use a
+	// single-value header the proxy overwrites, such as X-Real-IP: the first
+	// address of X-Forwarded-For is whatever the client sent. It is only read
+	// on requests from TrustedProxies, so per-IP login throttling sees clients
+	// rather than the proxy. Empty uses the connection's address.
+	ProxyHeader    string
+	TrustedProxies []string
+	// CouponFiles are the gzip files coupon codes are imported from when the
+	// coupons collection is empty
+	CouponFiles []string
+	// CouponImportDir holds the import's buckets and checkpoint so an
+	// interrupted import resumes where it stopped
+	CouponImportDir string
+	// CouponImportBuckets is how many buckets codes are hashed into. Each
+	// bucket is read into memory on its own while merging.
+	CouponImportBuckets int
 }
 
 var config *Config
@@ -18,9 +109,58 @@ func init() {
 	_ = godotenv.Load()
 
 	config = &Config{
-		JWTSecret: getEnvOrDefault("JWT_SECRET", "some-secret-key"),
-		MONGO_URI: getEnvOrDefault("MONGO_URI", "mongodb://localhost:27017"),
+		JWTSecret:                     getEnvOrDefault("JWT_SECRET", "some-secret-key"),
+		JWTSigningKeyPath:             getEnvOrDefault("JWT_SIGNING_KEY_PATH", ""),
+		JWTKeyID:                      getEnvOrDefault("JWT_KEY_ID", ""),
+		JWTVerificationKeys:           getListOrDefault("JWT_VERIFICATION_KEYS", nil),
+		LegacyAPIKeyHeader:            legacyAPIKeyHeader(),
+		MONGO_URI:                     getEnvOrDefault("MONGO_URI", "mongodb://localhost:27017"),
+		AccessTokenTTL:                getDurationOrDefault("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:               getDurationOrDefault("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		OrderCancellationWindow:       getDurationOrDefault("ORDER_CANCELLATION_WINDOW", 5*time.Minute),
+		OrderCancelBeforeStatus:       getEnvOrDefault("ORDER_CANCEL_BEFORE_STATUS", "preparing"),
+		IdempotencyKeyTTL:             getDurationOrDefault("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		AdminEmails:                   getListOrDefault("ADMIN_EMAILS", nil),
+		LoginMaxFailures:              getIntOrDefault("LOGIN_MAX_FAILURES", 5),
+		LoginMaxFailuresPerIP:         getIntOrDefault("LOGIN_MAX_FAILURES_PER_IP", 20),
+		LoginFailureWindow:            getDurationOrDefault("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginLockoutDuration:          getDurationOrDefault("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		LoginBackoffBase:              getDurationOrDefault("LOGIN_BACKOFF_BASE", time.Second),
+		PasswordResetTTL:              getDurationOrDefault("PASSWORD_RESET_TTL", time.Hour),
+		EmailVerificationTTL:          getDurationOrDefault("EMAIL_VERIFICATION_TTL", 48*time.Hour),
+		RequireVerifiedEmailForOrders: getBoolOrDefault("REQUIRE_VERIFIED_EMAIL_FOR_ORDERS", false),
+		PublicBaseURL:                 getEnvOrDefault("PUBLIC_BASE_URL", "http://localhost:3000"),
+		Notifier:                      getEnvOrDefault("NOTIFIER", "log"),
+		NotifierFile:                  getEnvOrDefault("NOTIFIER_FILE", "notifications.jsonl"),
+		NotifierLogBodies:             getBoolOrDefault("NOTIFIER_LOG_BODIES", false),
+		ProxyHeader:                   getEnvOrDefault("PROXY_HEADER", ""),
+		TrustedProxies:                getListOrDefault("TRUSTED_PROXIES", nil),
+		CouponFiles:                   getListOrDefault("COUPON_FILES", []string{"couponbase1.gz", "couponbase2.gz", "couponbase3.gz"}),
+		CouponImportDir:               getEnvOrDefault("COUPON_IMPORT_DIR", "coupon-import"),
+		CouponImportBuckets:           getIntOrDefault("COUPON_IMPORT_BUCKETS", 256),
 	}
+	config.OIDCProviders = getOIDCProviders(config.PublicBaseURL)
+	config.OIDCStateTTL = getDurationOrDefault("OIDC_STATE_TTL", 10*time.Minute)
+}
+
+// getOIDCProviders reads the providers named in OIDC_PROVIDERS. Each provider
+// is configured with OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET,
+// _REDIRECT_URL and _SCOPES.
+func getOIDCProviders(publicBaseURL string) []OIDCProvider {
+	var providers []OIDCProvider
+	for _, name := range getListOrDefault("OIDC_PROVIDERS", nil) {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, OIDCProvider{
+			Name:         name,
+			Issuer:       getEnvOrDefault(prefix+"ISSUER", ""),
+			ClientID:     getEnvOrDefault(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnvOrDefault(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  getEnvOrDefault(prefix+"REDIRECT_URL", strings.TrimSuffix(publicBaseURL, "/")+"/auth/oidc/"+name+"/callback"),
+			Scopes:       getListOrDefault(prefix+"SCOPES", []string{"openid", "email", "profile"}),
+		})
+	}
+	return providers
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -30,6 +170,58 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// legacyAPIKeyHeader defaults to api-key; setting LEGACY_API_KEY_HEADER to
+// "none" turns the fallback off
+func legacyAPIKeyHeader() string {
+	header := getEnvOrDefault("LEGACY_API_KEY_HEADER", "api-key")
+	if strings.EqualFold(header, "none") {
+		return ""
+	}
+	return header
+}
+
+func getDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
+func getIntOrDefault(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if number, err := strconv.Atoi(value); err == nil {
+			return number
+		}
+	}
+	return defaultValue
+}
+
+func getBoolOrDefault(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// getListOrDefault reads a comma separated list, dropping empty entries
+func getListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func GetConfig() *Config {
 	return config
-} 
\ No newline at end of file
+}
@@ -1,12 +1,17 @@
 package controllers
 
 import (
+	"errors"
 	"foodie-service/models"
 	"foodie-service/services"
 	"foodie-service/types"
 	"foodie-service/utils"
+	"math"
+	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 type AuthController struct {
@@ -31,11 +36,66 @@ func (ac *AuthController) Login(c *fiber.Ctx) error {
 		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
 	}
 
-	signInResponse, err := ac.services.Auth.SignIn(userDetails.Email, userDetails.Password)
+	signInResponse, err := ac.services.Auth.SignIn(userDetails.Email, userDetails.Password, c.IP(), c.Get(fiber.HeaderUserAgent))
 	if err != nil {
-		return utils.ErrorHandler("Invalid email or password", err.Error(), fiber.StatusUnauthorized, c)
+		var throttled *services.LoginThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			return utils.ErrorHandler("Too many login attempts", err.Error(), fiber.StatusTooManyRequests, c)
+		case errors.Is(err, services.ErrInvalidCredentials):
+			return utils.ErrorHandler("Invalid email or password", err.Error(), fiber.StatusUnauthorized, c)
+		}
+		return utils.ErrorHandler("Failed to log in", err.Error(), fiber.StatusInternalServerError, c)
 	}
-	return c.JSON(fiber.Map{"token": signInResponse.Token})
+	return c.JSON(signInResponse)
+}
+
+func (ac *AuthController) Refresh(c *fiber.Ctx) error {
+	var refreshRequest types.RefreshTokenRequest
+
+	if err := c.BodyParser(&refreshRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(refreshRequest); err != nil {
+		return utils.ErrorHandler("Validation failed", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	refreshResponse, err := ac.services.Auth.Refresh(refreshRequest.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidRefreshToken):
+			return utils.ErrorHandler("Invalid refresh token", err.Error(), fiber.StatusUnauthorized, c)
+		case errors.Is(err, services.ErrRefreshTokenReused):
+			return utils.ErrorHandler("Refresh token reused", err.Error(), fiber.StatusUnauthorized, c)
+		}
+		return utils.ErrorHandler("Failed to refresh token", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(refreshResponse)
+}
+
+func (ac *AuthController) Logout(c *fiber.Ctx) error {
+	var logoutRequest types.LogoutRequest
+
+	// The body is optional; without a refresh token only the access token is revoked
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&logoutRequest); err != nil {
+			return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+		}
+	}
+
+	userID := c.Locals("userID").(string)
+	tokenID, _ := c.Locals("tokenID").(string)
+	tokenExpiresAt, _ := c.Locals("tokenExpiresAt").(time.Time)
+	err := ac.services.Auth.Logout(userID, tokenID, tokenExpiresAt, logoutRequest.RefreshToken)
+	if errors.Is(err, services.ErrInvalidRefreshToken) {
+		return utils.ErrorHandler("Invalid refresh token", err.Error(), fiber.StatusUnauthorized, c)
+	}
+	if err != nil {
+		return utils.ErrorHandler("Failed to log out", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
 func (ac *AuthController) SignUp(c *fiber.Ctx) error {
@@ -56,3 +116,138 @@ func (ac *AuthController) SignUp(c *fiber.Ctx) error {
 	}
 	return c.JSON(fiber.Map{"userId": signUpResponse.UserID})
 }
+
+func (ac *AuthController) UpdateUserRole(c *fiber.Ctx) error {
+	var roleRequest types.UpdateUserRoleRequest
+
+	if err := c.BodyParser(&roleRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(roleRequest); err != nil {
+		return utils.ErrorHandler("Validation failed", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	user, err := ac.services.Auth.UpdateUserRole(c.Params("userId"), roleRequest.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidRole):
+			return utils.ErrorHandler("Invalid role", err.Error(), fiber.StatusBadRequest, c)
+		case err == mongo.ErrNoDocuments:
+			return utils.ErrorHandler("User not found", "No user found with the given ID", fiber.StatusNotFound, c)
+		}
+		return utils.ErrorHandler("Failed to update role", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(fiber.Map{"userId": user.UserID, "role": user.Role})
+}
+
+// JWKS publishes the public keys other services can verify tokens with
+func (ac *AuthController) JWKS(c *fiber.Ctx) error {
+	return c.JSON(utils.JWKS())
+}
+
+func (ac *AuthController) ForgotPassword(c *fiber.Ctx) error {
+	var forgotRequest types.ForgotPasswordRequest
+
+	if err := c.BodyParser(&forgotRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(forgotRequest); err != nil {
+		return utils.ErrorHandler("Validation failed", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := ac.services.Auth.ForgotPassword(forgotRequest.Email); err != nil {
+		return utils.ErrorHandler("Failed to start password reset", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(fiber.Map{"message": "If an account exists for this email, a password reset token has been sent"})
+}
+
+func (ac *AuthController) ResetPassword(c *fiber.Ctx) error {
+	var resetRequest types.ResetPasswordRequest
+
+	if err := c.BodyParser(&resetRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(resetRequest); err != nil {
+		return utils.ErrorHandler("Validation failed", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := ac.services.Auth.ResetPassword(resetRequest.Token, resetRequest.Password); err != nil {
+		switch {
+		case errors.Is(err, services.ErrWeakPassword):
+			return utils.ErrorHandler("Weak password", err.Error(), fiber.StatusBadRequest, c)
+		case errors.Is(err, services.ErrInvalidResetToken):
+			return utils.ErrorHandler("Invalid reset token", err.Error(), fiber.StatusBadRequest, c)
+		}
+		return utils.ErrorHandler("Failed to reset password", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(fiber.Map{"message": "Password updated. Please log in again."})
+}
+
+func (ac *AuthController) VerifyEmail(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if token == "" {
+		return utils.ErrorHandler("Invalid verification token", "token query parameter is required", fiber.StatusBadRequest, c)
+	}
+
+	if err := ac.services.Auth.VerifyEmail(token); err != nil {
+		if errors.Is(err, services.ErrInvalidVerifyToken) {
+			return utils.ErrorHandler("Invalid verification token", err.Error(), fiber.StatusBadRequest, c)
+		}
+		return utils.ErrorHandler("Failed to verify email", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(fiber.Map{"message": "Email verified successfully"})
+}
+
+func (ac *AuthController) ResendVerification(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := ac.services.Auth.ResendVerificationEmail(userID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrAlreadyVerified):
+			return utils.ErrorHandler("Already verified", err.Error(), fiber.StatusConflict, c)
+		case err == mongo.ErrNoDocuments:
+			return utils.ErrorHandler("User not found", "No user found for this token", fiber.StatusNotFound, c)
+		}
+		return utils.ErrorHandler("Failed to send verification email", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(fiber.Map{"message": "Verification email sent"})
+}
+
+// oidcErrorResponse maps social login errors to responses
+func oidcErrorResponse(err error, c *fiber.Ctx) error {
+	switch {
+	case errors.Is(err, services.ErrUnknownOIDCProvider):
+		return utils.ErrorHandler("Unknown identity provider", "No identity provider is configured with this name", fiber.StatusNotFound, c)
+	case errors.Is(err, services.ErrInvalidOIDCState):
+		return utils.ErrorHandler("Invalid login session", err.Error(), fiber.StatusBadRequest, c)
+	case errors.Is(err, services.ErrOIDCEmailNotVerified):
+		return utils.ErrorHandler("Email not verified", err.Error(), fiber.StatusForbidden, c)
+	case errors.Is(err, services.ErrOIDCLoginFailed):
+		return utils.ErrorHandler("Login failed", err.Error(), fiber.StatusUnauthorized, c)
+	case errors.Is(err, services.ErrOIDCProviderUnavailable):
+		return utils.ErrorHandler("Identity provider unavailable", err.Error(), fiber.StatusBadGateway, c)
+	}
+	return utils.ErrorHandler("Failed to log in", err.Error(), fiber.StatusInternalServerError, c)
+}
+
+// OIDCLogin redirects the user to the identity provider to sign in
+func (ac *AuthController) OIDCLogin(c *fiber.Ctx) error {
+	loginURL, err := ac.services.OIDC.LoginURL(c.Params("provider"))
+	if err != nil {
+		return oidcErrorResponse(err, c)
+	}
+	return c.Redirect(loginURL, fiber.StatusFound)
+}
+
+// OIDCCallback is where the identity provider sends the user back to. It
+// returns the same tokens as a password login.
+func (ac *AuthController) OIDCCallback(c *fiber.Ctx) error {
+	signInResponse, err := ac.services.OIDC.Callback(c.Params("provider"), c.Query("code"), c.Query("state"), c.Query("error"))
+	if err != nil {
+		return oidcErrorResponse(err, c)
+	}
+	return c.JSON(signInResponse)
+}
@@ -9,6 +9,9 @@ type BaseController struct {
 	ProductsController *ProductsController
 	OrdersController   *OrdersController
 	AuthController     *AuthController
+	CartController     *CartController
+	UsersController    *UsersController
+	CouponsController  *CouponsController
 }
 
 var baseController *BaseController
@@ -22,6 +25,9 @@ func NewBaseController(services *services.BaseService, models *models.BaseModel)
 		ProductsController: NewProductsController(services, models),
 		OrdersController:   NewOrdersController(services, models),
 		AuthController:     NewAuthController(services, models),
+		CartController:     NewCartController(services, models),
+		UsersController:    NewUsersController(services, models),
+		CouponsController:  NewCouponsController(services, models),
 	}
 	return baseController
 }
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"foodie-service/models"
+	"foodie-service/services"
+	"foodie-service/types"
+	"foodie-service/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type CartController struct {
+	services *services.BaseService
+	models   *models.BaseModel
+}
+
+var cartController *CartController
+
+func NewCartController(services *services.BaseService, models *models.BaseModel) *CartController {
+	if cartController != nil {
+		return cartController
+	}
+
+	return &CartController{
+		services: services,
+		models:   models,
+	}
+}
+
+func cartResponse(c *fiber.Ctx, message string, cart *types.CartDetails) error {
+	return c.JSON(fiber.Map{
+		"message": message,
+		"cart":    cart,
+	})
+}
+
+func (cc *CartController) GetCart(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	cart, err := cc.services.Cart.GetCart(userID)
+	if err != nil {
+		return utils.ErrorHandler("Error fetching cart", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return cartResponse(c, "Cart fetched successfully", cart)
+}
+
+func (cc *CartController) AddItem(c *fiber.Ctx) error {
+	var itemRequest types.CartItemRequest
+	if err := c.BodyParser(&itemRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(itemRequest); err != nil {
+		return utils.ErrorHandler("Invalid cart item", err.Error(), fiber.StatusUnprocessableEntity, c)
+	}
+
+	userID := c.Locals("userID").(string)
+
+	cart, err := cc.services.Cart.AddItem(userID, &itemRequest)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.ErrorHandler("Product not found", "No product found with the given ID", fiber.StatusNotFound, c)
+		}
+		return utils.ErrorHandler("Error updating cart", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return cartResponse(c, "Item added to cart", cart)
+}
+
+func (cc *CartController) UpdateItem(c *fiber.Ctx) error {
+	var itemRequest types.CartItemRequest
+	if err := c.BodyParser(&itemRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(itemRequest); err != nil {
+		return utils.ErrorHandler("Invalid cart item", err.Error(), fiber.StatusUnprocessableEntity, c)
+	}
+
+	userID := c.Locals("userID").(string)
+
+	cart, err := cc.services.Cart.UpdateItem(userID, &itemRequest)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.ErrorHandler("Item not in cart", "The product is not in the cart", fiber.StatusNotFound, c)
+		}
+		return utils.ErrorHandler("Error updating cart", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return cartResponse(c, "Cart updated successfully", cart)
+}
+
+func (cc *CartController) RemoveItem(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	cart, err := cc.services.Cart.RemoveItem(userID, c.Params("productId"))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.ErrorHandler("Item not in cart", "The product is not in the cart", fiber.StatusNotFound, c)
+		}
+		return utils.ErrorHandler("Error updating cart", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return cartResponse(c, "Item removed from cart", cart)
+}
+
+func (cc *CartController) ClearCart(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := cc.services.Cart.ClearCart(userID); err != nil {
+		return utils.ErrorHandler("Error clearing cart", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(fiber.Map{
+		"message": "Cart cleared successfully",
+	})
+}
+
+func (cc *CartController) ApplyCoupon(c *fiber.Ctx) error {
+	var couponRequest types.ApplyCouponRequest
+	if err := c.BodyParser(&couponRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(couponRequest); err != nil {
+		return utils.ErrorHandler("Invalid coupon data", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	userID := c.Locals("userID").(string)
+
+	cart, err := cc.services.Cart.ApplyCoupon(userID, couponRequest.CouponCode)
+	if err != nil {
+		var couponRejected *services.CouponRejectedError
+		if errors.As(err, &couponRejected) {
+			return couponRejectedResponse(couponRejected, c)
+		}
+		return utils.ErrorHandler("Error applying coupon", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return cartResponse(c, "Coupon applied successfully", cart)
+}
+
+func (cc *CartController) RemoveCoupon(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	cart, err := cc.services.Cart.RemoveCoupon(userID)
+	if err != nil {
+		return utils.ErrorHandler("Error removing coupon", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return cartResponse(c, "Coupon removed successfully", cart)
+}
+
+func (cc *CartController) Checkout(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var checkoutRequest types.CheckoutRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&checkoutRequest); err != nil {
+			return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+		}
+	}
+
+	var purchaseDetails *types.PurchaseDetails
+	var err error
+	if key := c.Get(idempotencyKeyHeader); key != "" {
+		body, _ := json.Marshal(checkoutRequest)
+		hash := sha256.Sum256(body)
+		purchaseDetails, err = cc.services.Cart.CheckoutWithIdempotencyKey(userID, checkoutRequest.AddressID, key, hex.EncodeToString(hash[:]))
+	} else {
+		purchaseDetails, err = cc.services.Cart.Checkout(userID, checkoutRequest.AddressID)
+	}
+	if err != nil {
+		var outOfStock *services.OutOfStockError
+		if errors.As(err, &outOfStock) {
+			return outOfStockResponse(outOfStock, c)
+		}
+		var couponRejected *services.CouponRejectedError
+		if errors.As(err, &couponRejected) {
+			return couponRejectedResponse(couponRejected, c)
+		}
+		switch {
+		case errors.Is(err, services.ErrIdempotencyKeyReused):
+			return utils.ErrorHandler("Idempotency key reused", err.Error(), fiber.StatusUnprocessableEntity, c)
+		case errors.Is(err, services.ErrIdempotencyKeyInFlight):
+			return utils.ErrorHandler("Request in progress", err.Error(), fiber.StatusConflict, c)
+		case errors.Is(err, services.ErrCartChanged):
+			return utils.ErrorHandler("Cart changed", "The cart changed during checkout; review it and check out again", fiber.StatusConflict, c)
+		case errors.Is(err, services.ErrCartEmpty):
+			return utils.ErrorHandler("Cart is empty", "Add items to the cart before checking out", fiber.StatusBadRequest, c)
+		case errors.Is(err, services.ErrEmailNotVerified):
+			return utils.ErrorHandler("Email not verified", err.Error(), fiber.StatusForbidden, c)
+		case errors.Is(err, services.ErrAddressNotFound):
+			return utils.ErrorHandler("Address not found", "No address found with the given ID", fiber.StatusNotFound, c)
+		case err == mongo.ErrNoDocuments:
+			return utils.ErrorHandler("Product not found", "No product found with the given ID", fiber.StatusNotFound, c)
+		}
+		return utils.ErrorHandler("Error placing order", err.Error(), fiber.StatusInternalServerError, c)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Order placed successfully",
+		"order":   purchaseDetails,
+	})
+}
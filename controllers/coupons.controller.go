@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"foodie-service/models"
+	"foodie-service/services"
+	"foodie-service/types"
+	"foodie-service/utils"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	defaultCouponsLimit = 50
+	maxCouponsLimit     = 200
+)
+
+type CouponsController struct {
+	services *services.BaseService
+	models   *models.BaseModel
+}
+
+var couponsController *CouponsController
+
+func NewCouponsController(services *services.BaseService, models *models.BaseModel) *CouponsController {
+	if couponsController != nil {
+		return couponsController
+	}
+
+	return &CouponsController{
+		services: services,
+		models:   models,
+	}
+}
+
+// couponErrorResponse maps coupon management errors to responses
+func couponErrorResponse(err error, c *fiber.Ctx) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidCouponRules):
+		return utils.ErrorHandler("Invalid coupon", err.Error(), fiber.StatusBadRequest, c)
+	case errors.Is(err, services.ErrCouponExists):
+		return utils.ErrorHandler("Coupon already exists", err.Error(), fiber.StatusConflict, c)
+	case err == mongo.ErrNoDocuments:
+		return utils.ErrorHandler("Coupon not found", "No coupon found with the given code", fiber.StatusNotFound, c)
+	}
+	return utils.ErrorHandler("Error updating coupon", err.Error(), fiber.StatusInternalServerError, c)
+}
+
+func (cc *CouponsController) ListCoupons(c *fiber.Ctx) error {
+	query := types.CouponQuery{
+		Prefix: c.Query("prefix"),
+		Type:   types.CouponType(c.Query("type")),
+		After:  c.Query("after"),
+		Limit:  defaultCouponsLimit,
+	}
+
+	switch query.Type {
+	case "", types.CouponTypePercentage, types.CouponTypeFixed, types.CouponTypeLegacy:
+	default:
+		return utils.ErrorHandler("Invalid type", "type must be one of percentage, fixed, legacy", fiber.StatusBadRequest, c)
+	}
+	if c.Query("active") != "" {
+		active, err := strconv.ParseBool(c.Query("active"))
+		if err != nil {
+			return utils.ErrorHandler("active is not valid", "active must be true or false", fiber.StatusBadRequest, c)
+		}
+		query.Active = &active
+	}
+	if c.Query("limit") != "" {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > maxCouponsLimit {
+			return utils.ErrorHandler("limit is not valid", fmt.Sprintf("limit must be an integer between 1 and %d", maxCouponsLimit), fiber.StatusBadRequest, c)
+		}
+		query.Limit = limit
+	}
+
+	coupons, next, err := cc.services.Coupons.ListCoupons(query)
+	if err != nil {
+		return utils.ErrorHandler("Error fetching coupons", err.Error(), fiber.StatusInternalServerError, c)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Coupons fetched successfully",
+		"coupons": coupons,
+		"page":    types.CouponPage{Limit: query.Limit, NextAfter: next},
+	})
+}
+
+// CheckCoupon is public and only says whether a code can be used
+func (cc *CouponsController) CheckCoupon(c *fiber.Ctx) error {
+	cartTotal, err := priceQuery(c, "cartTotal")
+	if err != nil {
+		return utils.ErrorHandler("cartTotal is not valid", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	check, err := cc.services.Coupons.CheckCoupon(c.Params("code"), cartTotal)
+	if err != nil {
+		return utils.ErrorHandler("Error checking coupon", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(check)
+}
+
+func (cc *CouponsController) GetCoupon(c *fiber.Ctx) error {
+	coupon, err := cc.services.Coupons.GetCoupon(c.Params("code"))
+	if err != nil {
+		return couponErrorResponse(err, c)
+	}
+	return c.JSON(fiber.Map{"coupon": coupon})
+}
+
+func (cc *CouponsController) CreateCoupon(c *fiber.Ctx) error {
+	var couponRequest types.CouponRequest
+	if err := c.BodyParser(&couponRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(couponRequest); err != nil {
+		return utils.ErrorHandler("Invalid coupon", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	coupon, err := cc.services.Coupons.CreateCoupon(c.Params("code"), &couponRequest)
+	if err != nil {
+		return couponErrorResponse(err, c)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Coupon created successfully",
+		"coupon":  coupon,
+	})
+}
+
+func (cc *CouponsController) UpdateCoupon(c *fiber.Ctx) error {
+	var patchRequest types.PatchCouponRequest
+	if err := c.BodyParser(&patchRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	coupon, err := cc.services.Coupons.UpdateCoupon(c.Params("code"), &patchRequest)
+	if err != nil {
+		return couponErrorResponse(err, c)
+	}
+	return c.JSON(fiber.Map{
+		"message": "Coupon updated successfully",
+		"coupon":  coupon,
+	})
+}
+
+func (cc *CouponsController) DeactivateCoupon(c *fiber.Ctx) error {
+	coupon, err := cc.services.Coupons.DeactivateCoupon(c.Params("code"))
+	if err != nil {
+		return couponErrorResponse(err, c)
+	}
+	return c.JSON(fiber.Map{
+		"message": "Coupon deactivated successfully",
+		"coupon":  coupon,
+	})
+}
+
+func (cc *CouponsController) GenerateCoupons(c *fiber.Ctx) error {
+	var generateRequest types.GenerateCouponsRequest
+	if err := c.BodyParser(&generateRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(generateRequest); err != nil {
+		return utils.ErrorHandler("Invalid coupon", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	coupons, err := cc.services.Coupons.GenerateCoupons(&generateRequest)
+	if err != nil && len(coupons) == 0 {
+		return couponErrorResponse(err, c)
+	}
+
+	codes := make([]string, len(coupons))
+	for i, coupon := range coupons {
+		codes[i] = coupon.Code
+	}
+	response := fiber.Map{
+		"message": "Coupons generated successfully",
+		"count":   len(codes),
+		"codes":   codes,
+	}
+	if err != nil {
+		// Some codes were created; report them so they are not lost
+		response["message"] = "Some coupons could not be generated"
+		response["error"] = err.Error()
+	}
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
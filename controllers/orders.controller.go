@@ -1,6 +1,10 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"foodie-service/models"
 	"foodie-service/services"
 	"foodie-service/types"
@@ -11,6 +15,8 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
+const idempotencyKeyHeader = "Idempotency-Key"
+
 type OrdersController struct {
 	services *services.BaseService
 	models   *models.BaseModel
@@ -42,8 +48,36 @@ func (oc *OrdersController) PlaceOrder(c *fiber.Ctx) error {
 
 	userID := c.Locals("userID").(string)
 
-	purchaseDetails, err := oc.services.Orders.PlaceOrder(orderRequest, userID)
+	var purchaseDetails *types.PurchaseDetails
+	var err error
+	if key := c.Get(idempotencyKeyHeader); key != "" {
+		// Hash the parsed request so formatting differences between retries
+		// do not count as a different body
+		body, _ := json.Marshal(orderRequest)
+		hash := sha256.Sum256(body)
+		purchaseDetails, err = oc.services.Orders.PlaceOrderWithIdempotencyKey(orderRequest, userID, key, hex.EncodeToString(hash[:]))
+	} else {
+		purchaseDetails, err = oc.services.Orders.PlaceOrder(orderRequest, userID)
+	}
 	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrIdempotencyKeyReused):
+			return utils.ErrorHandler("Idempotency key reused", err.Error(), fiber.StatusUnprocessableEntity, c)
+		case errors.Is(err, services.ErrIdempotencyKeyInFlight):
+			return utils.ErrorHandler("Request in progress", err.Error(), fiber.StatusConflict, c)
+		case errors.Is(err, services.ErrEmailNotVerified):
+			return utils.ErrorHandler("Email not verified", err.Error(), fiber.StatusForbidden, c)
+		case errors.Is(err, services.ErrAddressNotFound):
+			return utils.ErrorHandler("Address not found", "No address found with the given ID", fiber.StatusNotFound, c)
+		}
+		var outOfStock *services.OutOfStockError
+		if errors.As(err, &outOfStock) {
+			return outOfStockResponse(outOfStock, c)
+		}
+		var couponRejected *services.CouponRejectedError
+		if errors.As(err, &couponRejected) {
+			return couponRejectedResponse(couponRejected, c)
+		}
 		if err == mongo.ErrNoDocuments {
 			return utils.ErrorHandler("Product not found", "No product found with the given ID", fiber.StatusNotFound, c)
 		}
@@ -56,6 +90,31 @@ func (oc *OrdersController) PlaceOrder(c *fiber.Ctx) error {
 	})
 }
 
+// couponRejectedResponse reports a 422 in the usual error shape, with the
+// reason the coupon was rejected
+func couponRejectedResponse(err *services.CouponRejectedError, c *fiber.Ctx) error {
+	c.Status(fiber.StatusUnprocessableEntity)
+	return c.JSON(fiber.Map{
+		"errorType":    "Coupon rejected",
+		"errorMessage": err.Error(),
+		"status":       fiber.StatusUnprocessableEntity,
+		"couponCode":   err.Code,
+		"reason":       err.Reason,
+	})
+}
+
+// outOfStockResponse reports a 409 in the usual error shape, listing every item
+// that could not be reserved
+func outOfStockResponse(err *services.OutOfStockError, c *fiber.Ctx) error {
+	c.Status(fiber.StatusConflict)
+	return c.JSON(fiber.Map{
+		"errorType":    "Insufficient stock",
+		"errorMessage": err.Error(),
+		"status":       fiber.StatusConflict,
+		"items":        err.Items,
+	})
+}
+
 func (oc *OrdersController) GetOrders(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
 	limit := 5
@@ -86,13 +145,79 @@ func (oc *OrdersController) GetOrders(c *fiber.Ctx) error {
 	})
 }
 
-func (oc *OrdersController) FetchCoupons(c *fiber.Ctx) error {
-	coupons, err := oc.services.Coupons.FetchCoupons()
+func (oc *OrdersController) GetOrder(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	purchaseDetails, err := oc.services.Orders.GetOrder(c.Params("orderId"), userID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.ErrorHandler("Order not found", "No order found with the given ID", fiber.StatusNotFound, c)
+		}
+		return utils.ErrorHandler("Error fetching order", err.Error(), fiber.StatusInternalServerError, c)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Order fetched successfully",
+		"order":   purchaseDetails,
+	})
+}
+
+func (oc *OrdersController) UpdateOrderStatus(c *fiber.Ctx) error {
+	var statusRequest types.UpdateOrderStatusRequest
+	if err := c.BodyParser(&statusRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(statusRequest); err != nil {
+		return utils.ErrorHandler("Invalid status data", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	userID := c.Locals("userID").(string)
+
+	purchaseDetails, err := oc.services.Orders.UpdateOrderStatus(c.Params("orderId"), statusRequest.Status, statusRequest.Note, userID)
+	if err != nil {
+		switch {
+		case err == mongo.ErrNoDocuments:
+			return utils.ErrorHandler("Order not found", "No order found with the given ID", fiber.StatusNotFound, c)
+		case errors.Is(err, services.ErrInvalidOrderStatus):
+			return utils.ErrorHandler("Invalid order status", err.Error(), fiber.StatusBadRequest, c)
+		case errors.Is(err, services.ErrInvalidStatusTransition), errors.Is(err, services.ErrOrderStatusConflict):
+			return utils.ErrorHandler("Status change rejected", err.Error(), fiber.StatusConflict, c)
+		}
+		return utils.ErrorHandler("Error updating order status", err.Error(), fiber.StatusInternalServerError, c)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Order status updated successfully",
+		"order":   purchaseDetails,
+	})
+}
+
+func (oc *OrdersController) CancelOrder(c *fiber.Ctx) error {
+	var cancelRequest types.CancelOrderRequest
+	if err := c.BodyParser(&cancelRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(cancelRequest); err != nil {
+		return utils.ErrorHandler("Invalid cancellation data", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	userID := c.Locals("userID").(string)
+
+	purchaseDetails, err := oc.services.Orders.CancelOrder(c.Params("orderId"), userID, cancelRequest.Reason)
 	if err != nil {
-		return utils.ErrorHandler("Error fetching coupons", err.Error(), fiber.StatusInternalServerError, c)
+		switch {
+		case err == mongo.ErrNoDocuments:
+			return utils.ErrorHandler("Order not found", "No order found with the given ID", fiber.StatusNotFound, c)
+		case errors.Is(err, services.ErrCancellationNotAllowed), errors.Is(err, services.ErrOrderStatusConflict):
+			return utils.ErrorHandler("Cancellation rejected", err.Error(), fiber.StatusConflict, c)
+		}
+		return utils.ErrorHandler("Error cancelling order", err.Error(), fiber.StatusInternalServerError, c)
 	}
+
 	return c.JSON(fiber.Map{
-		"message": "Coupons fetched successfully",
-		"coupons": coupons,
+		"message": "Order cancelled successfully",
+		"order":   purchaseDetails,
 	})
-}
\ No newline at end of file
+}
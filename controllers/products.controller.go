@@ -2,6 +2,8 @@ package controllers
 
 import (
 	// "foodie-service/dbs"
+	"errors"
+	"fmt"
 
 	"foodie-service/models"
 	"foodie-service/services"
@@ -32,16 +34,74 @@ func NewProductsController(services *services.BaseService, models *models.BaseMo
 	}
 }
 
+const (
+	defaultProductsLimit = 20
+	maxProductsLimit     = 100
+)
+
+// priceQuery reads an optional non-negative price from the query string
+func priceQuery(c *fiber.Ctx, param string) (*float64, error) {
+	if c.Query(param) == "" {
+		return nil, nil
+	}
+	price, err := strconv.ParseFloat(c.Query(param), 64)
+	if err != nil || price < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative number", param)
+	}
+	return &price, nil
+}
+
 func (pc *ProductsController) GetProducts(c *fiber.Ctx) error {
+	query := types.ProductQuery{
+		IncludeArchived: c.QueryBool("includeArchived"),
+		Category:        c.Query("category"),
+		Search:          c.Query("q"),
+		Sort:            c.Query("sort"),
+		Limit:           defaultProductsLimit,
+	}
+
+	if !models.IsValidProductSort(query.Sort) {
+		return utils.ErrorHandler("Invalid sort", "sort must be one of price, -price, name, -name, newest", fiber.StatusBadRequest, c)
+	}
+	var err error
+	if query.MinPrice, err = priceQuery(c, "minPrice"); err != nil {
+		return utils.ErrorHandler("minPrice is not valid", err.Error(), fiber.StatusBadRequest, c)
+	}
+	if query.MaxPrice, err = priceQuery(c, "maxPrice"); err != nil {
+		return utils.ErrorHandler("maxPrice is not valid", err.Error(), fiber.StatusBadRequest, c)
+	}
+	if query.MinPrice != nil && query.MaxPrice != nil && *query.MinPrice > *query.MaxPrice {
+		return utils.ErrorHandler("Invalid price range", "minPrice must not exceed maxPrice", fiber.StatusBadRequest, c)
+	}
+	if c.Query("limit") != "" {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > maxProductsLimit {
+			return utils.ErrorHandler("limit is not valid", fmt.Sprintf("limit must be an integer between 1 and %d", maxProductsLimit), fiber.StatusBadRequest, c)
+		}
+		query.Limit = limit
+	}
+	if c.Query("offset") != "" {
+		offset, err := strconv.Atoi(c.Query("offset"))
+		if err != nil || offset < 0 {
+			return utils.ErrorHandler("offset is not valid", "offset must be a non-negative integer", fiber.StatusBadRequest, c)
+		}
+		query.Offset = offset
+	}
 
-	products, err := pc.models.Products.GetProducts(true)
+	products, total, err := pc.models.Products.GetProducts(true, query)
 	if err != nil {
 		return utils.ErrorHandler("Error fetching products", err.Error(), fiber.StatusInternalServerError, c)
 	}
 
+	page := types.ProductPage{Total: total, Limit: query.Limit, Offset: query.Offset}
+	if next := query.Offset + len(products); int64(next) < total {
+		page.NextOffset = &next
+	}
+
 	return c.JSON(fiber.Map{
 		"message":  "Products fetched successfully",
 		"products": products,
+		"page":     page,
 	})
 }
 
@@ -87,3 +147,50 @@ func (pc *ProductsController) InsertBulkProducts(c *fiber.Ctx) error {
 		"message": "Products inserted successfully",
 	})
 }
+
+func (pc *ProductsController) productUpdateResponse(product *types.Product, err error, message string, c *fiber.Ctx) error {
+	if err != nil {
+		switch {
+		case err == mongo.ErrNoDocuments:
+			return utils.ErrorHandler("Product not found", "No product found with the given ID", fiber.StatusNotFound, c)
+		case errors.Is(err, services.ErrInvalidProductUpdate):
+			return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+		}
+		return utils.ErrorHandler("Error updating product", err.Error(), fiber.StatusInternalServerError, c)
+	}
+	return c.JSON(fiber.Map{
+		"message": message,
+		"product": product,
+	})
+}
+
+func (pc *ProductsController) UpdateProduct(c *fiber.Ctx) error {
+	var updateRequest types.UpdateProductRequest
+
+	if err := c.BodyParser(&updateRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(updateRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	product, err := pc.services.Products.ReplaceProduct(c.Params("id"), &updateRequest)
+	return pc.productUpdateResponse(product, err, "Product updated successfully", c)
+}
+
+func (pc *ProductsController) PatchProduct(c *fiber.Ctx) error {
+	var patchRequest types.PatchProductRequest
+
+	if err := c.BodyParser(&patchRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	product, err := pc.services.Products.PatchProduct(c.Params("id"), &patchRequest)
+	return pc.productUpdateResponse(product, err, "Product updated successfully", c)
+}
+
+func (pc *ProductsController) DeleteProduct(c *fiber.Ctx) error {
+	product, err := pc.services.Products.ArchiveProduct(c.Params("id"))
+	return pc.productUpdateResponse(product, err, "Product archived successfully", c)
+}
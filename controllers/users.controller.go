@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"errors"
+	"foodie-service/models"
+	"foodie-service/services"
+	"foodie-service/types"
+	"foodie-service/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type UsersController struct {
+	services *services.BaseService
+	models   *models.BaseModel
+}
+
+var usersController *UsersController
+
+func NewUsersController(services *services.BaseService, models *models.BaseModel) *UsersController {
+	if usersController != nil {
+		return usersController
+	}
+
+	return &UsersController{
+		services: services,
+		models:   models,
+	}
+}
+
+// userErrorResponse maps profile and address book errors to responses
+func userErrorResponse(err error, c *fiber.Ctx) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidProfile):
+		return utils.ErrorHandler("Invalid profile", err.Error(), fiber.StatusBadRequest, c)
+	case errors.Is(err, services.ErrInvalidAddress):
+		return utils.ErrorHandler("Invalid address", err.Error(), fiber.StatusBadRequest, c)
+	case errors.Is(err, services.ErrAddressNotFound):
+		return utils.ErrorHandler("Address not found", "No address found with the given ID", fiber.StatusNotFound, c)
+	case errors.Is(err, services.ErrAddressConflict):
+		return utils.ErrorHandler("Address book changed", err.Error(), fiber.StatusConflict, c)
+	case err == mongo.ErrNoDocuments:
+		return utils.ErrorHandler("User not found", "No user found for this token", fiber.StatusNotFound, c)
+	}
+	return utils.ErrorHandler("Error updating profile", err.Error(), fiber.StatusInternalServerError, c)
+}
+
+func (uc *UsersController) GetProfile(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	profile, err := uc.services.Users.GetProfile(userID)
+	if err != nil {
+		return userErrorResponse(err, c)
+	}
+	return c.JSON(profile)
+}
+
+func (uc *UsersController) UpdateProfile(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var profileRequest types.UpdateProfileRequest
+	if err := c.BodyParser(&profileRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	profile, err := uc.services.Users.UpdateProfile(userID, &profileRequest)
+	if err != nil {
+		return userErrorResponse(err, c)
+	}
+	return c.JSON(profile)
+}
+
+func (uc *UsersController) GetAddresses(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	addresses, err := uc.services.Users.GetAddresses(userID)
+	if err != nil {
+		return userErrorResponse(err, c)
+	}
+	return c.JSON(fiber.Map{"addresses": addresses})
+}
+
+func (uc *UsersController) GetAddress(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	address, err := uc.services.Users.GetAddress(userID, c.Params("addressId"))
+	if err != nil {
+		return userErrorResponse(err, c)
+	}
+	return c.JSON(address)
+}
+
+func (uc *UsersController) AddAddress(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var addressRequest types.AddressRequest
+	if err := c.BodyParser(&addressRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	if err := utils.Validate(addressRequest); err != nil {
+		return utils.ErrorHandler("Validation failed", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	address, err := uc.services.Users.AddAddress(userID, &addressRequest)
+	if err != nil {
+		return userErrorResponse(err, c)
+	}
+	return c.Status(fiber.StatusCreated).JSON(address)
+}
+
+func (uc *UsersController) UpdateAddress(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var addressRequest types.PatchAddressRequest
+	if err := c.BodyParser(&addressRequest); err != nil {
+		return utils.ErrorHandler("Invalid request body", err.Error(), fiber.StatusBadRequest, c)
+	}
+
+	address, err := uc.services.Users.UpdateAddress(userID, c.Params("addressId"), &addressRequest)
+	if err != nil {
+		return userErrorResponse(err, c)
+	}
+	return c.JSON(address)
+}
+
+func (uc *UsersController) DeleteAddress(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := uc.services.Users.DeleteAddress(userID, c.Params("addressId")); err != nil {
+		return userErrorResponse(err, c)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -61,3 +61,19 @@ func MongoClient(readPreference string) (*Mongo, error) {
 		MongoClient: client,
 	}, nil
 }
+
+// WithTransaction runs fn inside a multi-document transaction. Operations in fn
+// must use the context it is given to take part in the transaction. The
+// deployment has to be a replica set or sharded cluster.
+func (m *Mongo) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := m.MongoClient.StartSession()
+	if err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
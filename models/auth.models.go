@@ -4,22 +4,97 @@ import (
 	"context"
 	"fmt"
 	"foodie-service/database"
+	"foodie-service/types"
 	"time"
 
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
+// Address is an entry in a user's address book, also copied onto orders
+type Address struct {
+	AddressID    string `json:"addressId" bson:"addressId"`
+	Label        string `json:"label" bson:"label"`
+	Recipient    string `json:"recipient,omitempty" bson:"recipient,omitempty"`
+	Line1        string `json:"line1" bson:"line1"`
+	Line2        string `json:"line2,omitempty" bson:"line2,omitempty"`
+	City         string `json:"city" bson:"city"`
+	State        string `json:"state,omitempty" bson:"state,omitempty"`
+	PostalCode   string `json:"postalCode" bson:"postalCode"`
+	Country      string `json:"country" bson:"country"`
+	Phone        string `json:"phone,omitempty" bson:"phone,omitempty"`
+	Instructions string `json:"instructions,omitempty" bson:"instructions,omitempty"`
+	IsDefault    bool   `json:"isDefault" bson:"isDefault"`
+}
+
+// Identity links a user to an account at an OpenID Connect provider
+type Identity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"subject" bson:"subject"`
+	Email    string    `json:"email" bson:"email"`
+	LinkedAt time.Time `json:"linkedAt" bson:"linkedAt"`
+}
+
+// UserSchema is an account. Verified is set once the user follows the link
+// emailed on signup.
 type UserSchema struct {
-	ID        string    `json:"_id" bson:"_id"`
-	UserID    string    `json:"userId" bson:"userId" unique:"true"`
-	Email     string    `json:"email" bson:"email" unique:"true"`
-	Password  string    `json:"password" bson:"password"`
-	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	ID         string     `json:"_id" bson:"_id"`
+	UserID     string     `json:"userId" bson:"userId" unique:"true"`
+	Email      string     `json:"email" bson:"email" unique:"true"`
+	Password   string     `json:"password" bson:"password"`
+	Name       string     `json:"name,omitempty" bson:"name,omitempty"`
+	Phone      string     `json:"phone,omitempty" bson:"phone,omitempty"`
+	Addresses  []Address  `json:"addresses,omitempty" bson:"addresses,omitempty"`
+	Identities []Identity `json:"identities,omitempty" bson:"identities,omitempty"`
+	Role       types.Role `json:"role" bson:"role"`
+	Verified   bool       `json:"verified" bson:"verified"`
+	VerifiedAt *time.Time `json:"verifiedAt,omitempty" bson:"verifiedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt" bson:"updatedAt"`
+}
+
+// EffectiveRole returns the user's role, treating accounts created before
+// roles existed as customers
+func (u *UserSchema) EffectiveRole() types.Role {
+	if u.Role == "" {
+		return types.RoleCustomer
+	}
+	return u.Role
+}
+
+// ToProfile returns the parts of a user that are shown to the user
+func (u *UserSchema) ToProfile() *types.Profile {
+	return &types.Profile{
+		UserID:    u.UserID,
+		Email:     u.Email,
+		Name:      u.Name,
+		Phone:     u.Phone,
+		Role:      u.EffectiveRole(),
+		Verified:  u.Verified,
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+// DefaultAddress returns the user's default address, or nil when the address
+// book is empty
+func (u *UserSchema) DefaultAddress() *Address {
+	for i := range u.Addresses {
+		if u.Addresses[i].IsDefault {
+			return &u.Addresses[i]
+		}
+	}
+	return nil
+}
+
+func (u *UserSchema) FindAddress(addressID string) *Address {
+	for i := range u.Addresses {
+		if u.Addresses[i].AddressID == addressID {
+			return &u.Addresses[i]
+		}
+	}
+	return nil
 }
 
 type AuthModel struct {
@@ -40,6 +115,12 @@ func (am *AuthModel) createUniqueIndex() error {
 			Keys:    bson.M{"userId": 1},
 			Options: options.Index().SetUnique(true),
 		},
+		{
+			// One provider account can only be linked to one user
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+		},
 	}
 
 	// Create all indexes
@@ -70,19 +151,90 @@ func (am *AuthModel) GetUserByEmail(email string) (*UserSchema, error) {
 	var user *UserSchema
 	err := collection.FindOne(context.Background(), filter).Decode(&user)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
-	fmt.Println(user)
 	return user, nil
 }
 
+// UserIDForEmail returns the userId of the user with email, or "" when there
+// is none
+func (am *AuthModel) UserIDForEmail(email string) (string, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	var user UserSchema
+	opts := options.FindOne().SetProjection(bson.M{"userId": 1})
+	err := collection.FindOne(context.Background(), bson.M{"email": email}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return user.UserID, nil
+}
+
+// GetUserByUserID finds a user by uuid, which unlike the email address never
+// changes
+func (am *AuthModel) GetUserByUserID(userID string) (*UserSchema, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	var user UserSchema
+	err := collection.FindOne(context.Background(), bson.M{"userId": userID}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserByIdentity finds the user linked to an account at an OpenID Connect
+// provider
+func (am *AuthModel) GetUserByIdentity(provider string, subject string) (*UserSchema, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+	var user UserSchema
+	if err := collection.FindOne(context.Background(), filter).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LinkIdentity adds a provider account to a user. When the user had not
+// verified their email, the provider's verification counts instead and the
+// password is removed, since whoever set it never proved they own the email.
+func (am *AuthModel) LinkIdentity(userID string, identity Identity) (*UserSchema, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	now := time.Now()
+	identity.LinkedAt = now
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"identities": bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$identities", bson.A{}}}, bson.M{"$literal": bson.A{identity}}}},
+			"password":   bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$verified", true}}, "$password", ""}},
+			"verified":   true,
+			"verifiedAt": bson.M{"$ifNull": bson.A{"$verifiedAt", now}},
+			"updatedAt":  now,
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user UserSchema
+	err := collection.FindOneAndUpdate(context.Background(), bson.M{"userId": userID}, update, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (am *AuthModel) CreateUser(user *UserSchema) (*UserSchema, error) {
 	db := am.dbp
 	collection := db.MongoClient.Database("foodie").Collection("users")
 
-	user.ID = primitive.NewObjectID().Hex()
+	user.ID = bson.NewObjectID().Hex()
 	user.UserID = uuid.New().String()
+	if user.Role == "" {
+		user.Role = types.RoleCustomer
+	}
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = time.Now()
 
@@ -92,3 +244,92 @@ func (am *AuthModel) CreateUser(user *UserSchema) (*UserSchema, error) {
 	}
 	return user, nil
 }
+
+func (am *AuthModel) UpdateUserRole(userID string, role types.Role) (*UserSchema, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	filter := bson.M{"userId": userID}
+	update := bson.M{"$set": bson.M{"role": role, "updatedAt": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user UserSchema
+	err := collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateUserPassword replaces the bcrypt hash of a user's password
+func (am *AuthModel) UpdateUserPassword(userID string, passwordHash string) (*UserSchema, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	filter := bson.M{"userId": userID}
+	update := bson.M{"$set": bson.M{"password": passwordHash, "updatedAt": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user UserSchema
+	err := collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (am *AuthModel) MarkUserVerified(userID string) error {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	now := time.Now()
+	filter := bson.M{"userId": userID}
+	update := bson.M{"$set": bson.M{"verified": true, "verifiedAt": now, "updatedAt": now}}
+	result, err := collection.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// UpdateUserProfile sets and unsets profile fields and returns the user as it
+// is after the update
+func (am *AuthModel) UpdateUserProfile(userID string, set bson.M, unset ...string) (*UserSchema, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	set["updatedAt"] = time.Now()
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		fields := bson.M{}
+		for _, field := range unset {
+			fields[field] = ""
+		}
+		update["$unset"] = fields
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user UserSchema
+	err := collection.FindOneAndUpdate(context.Background(), bson.M{"userId": userID}, update, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ReplaceUserAddresses writes a user's whole address book, but only if the
+// user has not been updated since lastUpdatedAt. It returns
+// mongo.ErrNoDocuments when someone else changed the user first.
+func (am *AuthModel) ReplaceUserAddresses(userID string, addresses []Address, lastUpdatedAt time.Time) (*UserSchema, error) {
+	collection := am.dbp.MongoClient.Database("foodie").Collection("users")
+
+	filter := bson.M{"userId": userID, "updatedAt": lastUpdatedAt}
+	update := bson.M{"$set": bson.M{"addresses": addresses, "updatedAt": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user UserSchema
+	err := collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
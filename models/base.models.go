@@ -1,14 +1,22 @@
 package models
 
 import (
+	"context"
 	"foodie-service/database"
 )
 
 type BaseModel struct {
-	Products *ProductsModel
-	Orders   *OrdersModel
-	Auth     *AuthModel
-	Coupons  *CouponModel
+	Products    *ProductsModel
+	Orders      *OrdersModel
+	Auth        *AuthModel
+	Coupons     *CouponModel
+	Cart        *CartModel
+	Idempotency *IdempotencyModel
+	Tokens      *TokensModel
+	Logins      *LoginAttemptsModel
+	OIDC        *OIDCModel
+
+	dbp *database.Mongo
 }
 
 var baseModel *BaseModel
@@ -19,10 +27,22 @@ func NewBaseModel(mongoClientPrimary *database.Mongo, mongoClientSecondary *data
 	}
 
 	baseModel = &BaseModel{
-		Products: NewProductsModel(mongoClientPrimary, mongoClientSecondary),
-		Orders:   NewOrdersModel(mongoClientPrimary, mongoClientSecondary),
-		Auth:     NewAuthModel(mongoClientPrimary, mongoClientSecondary),
-		Coupons:  NewCouponModel(mongoClientPrimary, mongoClientSecondary),
+		Products:    NewProductsModel(mongoClientPrimary, mongoClientSecondary),
+		Orders:      NewOrdersModel(mongoClientPrimary, mongoClientSecondary),
+		Auth:        NewAuthModel(mongoClientPrimary, mongoClientSecondary),
+		Coupons:     NewCouponModel(mongoClientPrimary, mongoClientSecondary),
+		Cart:        NewCartModel(mongoClientPrimary, mongoClientSecondary),
+		Idempotency: NewIdempotencyModel(mongoClientPrimary, mongoClientSecondary),
+		Tokens:      NewTokensModel(mongoClientPrimary, mongoClientSecondary),
+		Logins:      NewLoginAttemptsModel(mongoClientPrimary, mongoClientSecondary),
+		OIDC:        NewOIDCModel(mongoClientPrimary, mongoClientSecondary),
+		dbp:         mongoClientPrimary,
 	}
 	return baseModel
 }
+
+// WithTransaction runs fn in a transaction on the primary deployment; model
+// calls made with the context passed to fn join the transaction
+func (bm *BaseModel) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return bm.dbp.WithTransaction(ctx, fn)
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"foodie-service/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type CartItem struct {
+	ProductID string `json:"productId" bson:"productId"`
+	Quantity  int    `json:"quantity" bson:"quantity"`
+}
+
+type CartSchema struct {
+	ID         string     `json:"_id" bson:"_id"`
+	UserID     string     `json:"userId" bson:"userId" unique:"true"`
+	Items      []CartItem `json:"items" bson:"items"`
+	CouponCode string     `json:"couponCode" bson:"couponCode"`
+	InsertedAt time.Time  `json:"insertedAt" bson:"insertedAt"`
+	UpdatedAt  time.Time  `json:"updatedAt" bson:"updatedAt"`
+}
+
+type CartModel struct {
+	dbp *database.Mongo
+	dbs *database.Mongo
+}
+
+func (cm *CartModel) createUniqueIndex() error {
+	collection := cm.dbp.MongoClient.Database("foodie").Collection("carts")
+
+	// Every user has at most one cart
+	indexModel := mongo.IndexModel{
+		Keys:    bson.M{"userId": 1},
+		Options: options.Index().SetUnique(true),
+	}
+
+	_, err := collection.Indexes().CreateOne(context.TODO(), indexModel)
+	return err
+}
+
+func NewCartModel(dbp *database.Mongo, dbs *database.Mongo) *CartModel {
+	cm := &CartModel{dbp: dbp, dbs: dbs}
+
+	if err := cm.createUniqueIndex(); err != nil {
+		panic(fmt.Sprintf("failed to create unique index: %v", err))
+	}
+	return cm
+}
+
+func (cm *CartModel) collection() *mongo.Collection {
+	return cm.dbp.MongoClient.Database("foodie").Collection("carts")
+}
+
+// GetCart returns the user's cart, or mongo.ErrNoDocuments if they have never
+// added anything
+func (cm *CartModel) GetCart(userID string) (*CartSchema, error) {
+	var cart CartSchema
+	err := cm.collection().FindOne(context.TODO(), bson.M{"userId": userID}).Decode(&cart)
+	if err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// upsertCart applies update to the user's cart, creating the cart when it does
+// not exist yet
+func (cm *CartModel) upsertCart(userID string, filter bson.M, update bson.M) (*mongo.UpdateResult, error) {
+	now := time.Now()
+	filter["userId"] = userID
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+	}
+	set["updatedAt"] = now
+	update["$set"] = set
+	update["$setOnInsert"] = bson.M{
+		"_id":        primitive.NewObjectID().Hex(),
+		"insertedAt": now,
+	}
+	return cm.collection().UpdateOne(context.TODO(), filter, update, options.UpdateOne().SetUpsert(true))
+}
+
+// AddItem adds quantity of a product to the cart, merging with an existing line
+// for the same product
+func (cm *CartModel) AddItem(userID string, productID string, quantity int) error {
+	now := time.Now()
+	result, err := cm.collection().UpdateOne(context.TODO(),
+		bson.M{"userId": userID, "items.productId": productID},
+		bson.M{"$inc": bson.M{"items.$.quantity": quantity}, "$set": bson.M{"updatedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	_, err = cm.upsertCart(userID,
+		bson.M{"items.productId": bson.M{"$ne": productID}},
+		bson.M{"$push": bson.M{"items": CartItem{ProductID: productID, Quantity: quantity}}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent request added the same product first; merge into it
+		return cm.AddItem(userID, productID, quantity)
+	}
+	return err
+}
+
+// SetItemQuantity replaces the quantity of a product already in the cart
+func (cm *CartModel) SetItemQuantity(userID string, productID string, quantity int) error {
+	result, err := cm.collection().UpdateOne(context.TODO(),
+		bson.M{"userId": userID, "items.productId": productID},
+		bson.M{"$set": bson.M{"items.$.quantity": quantity, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (cm *CartModel) RemoveItem(userID string, productID string) error {
+	result, err := cm.collection().UpdateOne(context.TODO(),
+		bson.M{"userId": userID, "items.productId": productID},
+		bson.M{"$pull": bson.M{"items": bson.M{"productId": productID}}, "$set": bson.M{"updatedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (cm *CartModel) SetCoupon(userID string, couponCode string) error {
+	_, err := cm.upsertCart(userID, bson.M{}, bson.M{
+		"$set": bson.M{"couponCode": couponCode},
+	})
+	return err
+}
+
+// DeleteCheckedOutCart deletes cart as part of the checkout transaction in
+// ctx. It reports false, leaving the cart as it is, when the cart was changed
+// after it was read.
+func (cm *CartModel) DeleteCheckedOutCart(ctx context.Context, cart *CartSchema) (bool, error) {
+	result, err := cm.collection().DeleteOne(ctx, bson.M{"_id": cart.ID, "updatedAt": cart.UpdatedAt})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (cm *CartModel) ClearCart(userID string) error {
+	_, err := cm.collection().DeleteOne(context.TODO(), bson.M{"userId": userID})
+	return err
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const couponRedemptionsCollection = "coupon_redemptions"
+
+// CouponRedemptionSchema records that an order used a coupon. ReleasedAt is
+// set when the order is cancelled and the use no longer counts.
+type CouponRedemptionSchema struct {
+	ID         string     `json:"_id" bson:"_id"`
+	Code       string     `json:"code" bson:"code"`
+	UserID     string     `json:"userId" bson:"userId"`
+	OrderID    string     `json:"orderId" bson:"orderId"`
+	RedeemedAt time.Time  `json:"redeemedAt" bson:"redeemedAt"`
+	ReleasedAt *time.Time `json:"releasedAt,omitempty" bson:"releasedAt,omitempty"`
+}
+
+func (m *CouponModel) createRedemptionIndexes(ctx context.Context) error {
+	collection := m.dbp.MongoClient.Database("foodie").Collection(couponRedemptionsCollection)
+
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "code", Value: 1}, {Key: "userId", Value: 1}, {Key: "orderId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"orderId": 1},
+			Options: options.Index(),
+		},
+	}
+	for _, model := range indexModels {
+		if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
+}
+
+// IncrementRedemptions counts one more use of a coupon, but only while it is
+// below its maxRedemptions. It returns the coupon as it is after the update,
+// or nil when the limit was already reached. Every redemption writes the
+// coupon document, so concurrent transactions redeeming the same coupon
+// conflict and are retried one after the other.
+func (m *CouponModel) IncrementRedemptions(ctx context.Context, code string) (*Coupon, error) {
+	collection := m.dbp.MongoClient.Database("foodie").Collection(couponCollection)
+
+	filter := bson.M{
+		"code": code,
+		"$expr": bson.M{"$or": bson.A{
+			bson.M{"$lte": bson.A{bson.M{"$ifNull": bson.A{"$maxRedemptions", 0}}, 0}},
+			bson.M{"$lt": bson.A{bson.M{"$ifNull": bson.A{"$redemptions", 0}}, "$maxRedemptions"}},
+		}},
+	}
+	update := bson.M{"$inc": bson.M{"redemptions": 1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var coupon Coupon
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&coupon)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// CountUserRedemptions counts the unreleased uses of a coupon by a user
+func (m *CouponModel) CountUserRedemptions(ctx context.Context, code string, userID string) (int64, error) {
+	collection := m.dbp.MongoClient.Database("foodie").Collection(couponRedemptionsCollection)
+
+	filter := bson.M{"code": code, "userId": userID, "releasedAt": bson.M{"$exists": false}}
+	return collection.CountDocuments(ctx, filter)
+}
+
+func (m *CouponModel) InsertRedemption(ctx context.Context, redemption *CouponRedemptionSchema) error {
+	collection := m.dbp.MongoClient.Database("foodie").Collection(couponRedemptionsCollection)
+
+	redemption.ID = bson.NewObjectID().Hex()
+	redemption.RedeemedAt = time.Now()
+	_, err := collection.InsertOne(ctx, redemption)
+	return err
+}
+
+// ReleaseRedemption hands back the coupon used by an order so it counts
+// towards no limit. It returns nil when the order used no coupon or it was
+// already released, so calling it twice releases the coupon once.
+func (m *CouponModel) ReleaseRedemption(ctx context.Context, orderID string) (*CouponRedemptionSchema, error) {
+	db := m.dbp.MongoClient.Database("foodie")
+
+	var redemption CouponRedemptionSchema
+	filter := bson.M{"orderId": orderID, "releasedAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"releasedAt": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := db.Collection(couponRedemptionsCollection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&redemption)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Collection(couponCollection).UpdateOne(ctx,
+		bson.M{"code": redemption.Code, "redemptions": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"redemptions": -1}})
+	if err != nil {
+		return nil, err
+	}
+	return &redemption, nil
+}
@@ -2,9 +2,13 @@ package models
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"foodie-service/database"
+	"foodie-service/types"
 	"log"
+	"regexp"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,12 +21,82 @@ const (
 	couponCollection = "coupons"
 )
 
-// Coupon represents a coupon document in the database
+// legacyCouponPercentage is the discount given by imported codes, which were
+// created before coupons had rules
+const legacyCouponPercentage = 10
+
+// Coupon represents a coupon document in the database. Codes from the gzip
+// import only have FileList and Appearances; see IsLegacy.
+//
+// Value is a percentage or an amount depending on Type. MaxDiscount caps the
+// discount of percentage coupons. Zero MinOrderValue, MaxRedemptions and
+// MaxRedemptionsPerUser mean no limit, and empty Categories and ProductIDs
+// make every item eligible. A nil Active counts as active. Redemptions counts
+// the orders currently using the coupon; see IncrementRedemptions.
 type Coupon struct {
-	ID          string   `json:"_id" bson:"_id"`
-	Code        string   `json:"code" bson:"code" unique:"true"`
-	FileList    []string `json:"fileList" bson:"fileList"`
-	Appearances int      `json:"appearances" bson:"appearances"`
+	ID                    string           `json:"_id" bson:"_id"`
+	Code                  string           `json:"code" bson:"code" unique:"true"`
+	FileList              []string         `json:"fileList,omitempty" bson:"fileList,omitempty"`
+	Appearances           int              `json:"appearances,omitempty" bson:"appearances,omitempty"`
+	Type                  types.CouponType `json:"type,omitempty" bson:"type,omitempty"`
+	Value                 float64          `json:"value,omitempty" bson:"value,omitempty"`
+	MaxDiscount           float64          `json:"maxDiscount,omitempty" bson:"maxDiscount,omitempty"`
+	MinOrderValue         float64          `json:"minOrderValue,omitempty" bson:"minOrderValue,omitempty"`
+	StartsAt              *time.Time       `json:"startsAt,omitempty" bson:"startsAt,omitempty"`
+	EndsAt                *time.Time       `json:"endsAt,omitempty" bson:"endsAt,omitempty"`
+	MaxRedemptions        int              `json:"maxRedemptions,omitempty" bson:"maxRedemptions,omitempty"`
+	MaxRedemptionsPerUser int              `json:"maxRedemptionsPerUser,omitempty" bson:"maxRedemptionsPerUser,omitempty"`
+	Redemptions           int              `json:"redemptions,omitempty" bson:"redemptions,omitempty"`
+	Categories            []string         `json:"categories,omitempty" bson:"categories,omitempty"`
+	ProductIDs            []string         `json:"productIds,omitempty" bson:"productIds,omitempty"`
+	Active                *bool            `json:"active,omitempty" bson:"active,omitempty"`
+	CreatedAt             *time.Time       `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+	UpdatedAt             *time.Time       `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+// IsLegacy reports whether the coupon came from the gzip import before
+// coupons had rules
+func (c *Coupon) IsLegacy() bool {
+	return c.Type == ""
+}
+
+// IsActive reports whether the coupon can be used at all. Imported codes are
+// only valid once they appeared in at least two files.
+func (c *Coupon) IsActive() bool {
+	if c.Active != nil && !*c.Active {
+		return false
+	}
+	if c.IsLegacy() {
+		return c.Appearances >= 2
+	}
+	return true
+}
+
+// DiscountType returns the coupon's type and value, giving imported codes
+// their historical 10% off
+func (c *Coupon) DiscountType() (types.CouponType, float64) {
+	if c.IsLegacy() {
+		return types.CouponTypePercentage, legacyCouponPercentage
+	}
+	return c.Type, c.Value
+}
+
+// AppliesTo reports whether an order line is eligible for the discount
+func (c *Coupon) AppliesTo(item types.LineItem) bool {
+	if len(c.Categories) == 0 && len(c.ProductIDs) == 0 {
+		return true
+	}
+	for _, productID := range c.ProductIDs {
+		if productID == item.ProductID {
+			return true
+		}
+	}
+	for _, category := range c.Categories {
+		if strings.EqualFold(category, item.Category) {
+			return true
+		}
+	}
+	return false
 }
 
 type TempCoupon struct {
@@ -48,7 +122,7 @@ func (m *CouponModel) InitCollection(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to create index: %v", err)
 	}
-	return nil
+	return m.createRedemptionIndexes(ctx)
 }
 
 func (m *CouponModel) CollectionExists(ctx context.Context) (bool, error) {
@@ -60,114 +134,50 @@ func (m *CouponModel) CollectionExists(ctx context.Context) (bool, error) {
 	return count > 0, nil
 }
 
-func (m *CouponModel) BulkUpsertCoupons(ctx context.Context, codes []string) error {
-	if len(codes) == 0 {
+// UpsertImportedCoupons stores codes found by the gzip import. Codes that
+// already exist are left as they are, so a batch can be written again after
+// an interrupted import without creating duplicates or overwriting coupons
+// an admin has since changed.
+func (m *CouponModel) UpsertImportedCoupons(ctx context.Context, coupons []Coupon) error {
+	if len(coupons) == 0 {
 		return nil
 	}
 
-	startTime := time.Now()
-	totalRecords := len(codes)
-	log.Printf("Starting bulk upsert of %d records...", totalRecords)
-
-	const batchSize = 1000
-	db := m.dbp.MongoClient.Database("foodie")
-	collection := db.Collection(couponCollection)
+	const batchSize = 10000
+	collection := m.dbp.MongoClient.Database("foodie").Collection(couponCollection)
+	opts := options.BulkWrite().SetOrdered(false)
 
-	for i := 0; i < len(codes); i += batchSize {
-		batchStartTime := time.Now()
+	for i := 0; i < len(coupons); i += batchSize {
 		end := i + batchSize
-		if end > len(codes) {
-			end = len(codes)
+		if end > len(coupons) {
+			end = len(coupons)
 		}
 
-		models := make([]mongo.WriteModel, end-i)
-		for j, code := range codes[i:end] {
-			update := mongo.NewUpdateOneModel()
-			update.SetFilter(bson.M{"code": code})
-			update.SetUpdate(bson.M{"$inc": bson.M{"appearances": 1}})
-			update.SetUpsert(true)
-			models[j] = update
+		writes := make([]mongo.WriteModel, 0, end-i)
+		for _, coupon := range coupons[i:end] {
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"code": coupon.Code}).
+				SetUpdate(bson.M{"$setOnInsert": bson.M{
+					"_id":         primitive.NewObjectID().Hex(),
+					"code":        coupon.Code,
+					"fileList":    coupon.FileList,
+					"appearances": coupon.Appearances,
+				}}).
+				SetUpsert(true))
 		}
 
-		opts := options.BulkWrite().SetOrdered(false)
-		_, err := collection.BulkWrite(ctx, models, opts)
+		var err error
+		for retries := 0; retries < 3; retries++ {
+			if _, err = collection.BulkWrite(ctx, writes, opts); err == nil {
+				break
+			}
+			log.Printf("Retry %d for coupons %d-%d due to error: %v", retries+1, i, end, err)
+			time.Sleep(time.Second * time.Duration(retries+1))
+		}
 		if err != nil {
-			return fmt.Errorf("bulk upsert failed at batch %d-%d: %v", i, end, err)
+			return fmt.Errorf("bulk upsert failed at coupons %d-%d: %v", i, end, err)
 		}
-
-		progress := float64(end) / float64(totalRecords) * 100
-		batchDuration := time.Since(batchStartTime)
-		log.Printf("Processed batch %d-%d (%.2f%%) in %v", i, end, progress, batchDuration)
-	}
-
-	totalDuration := time.Since(startTime)
-	log.Printf("Completed bulk upsert of %d records in %v", totalRecords, totalDuration)
-	return nil
-}
-
-func (m *CouponModel) OptimizedBulkInsert(ctx context.Context, coupons []Coupon) error {
-	if len(coupons) == 0 {
-		return nil
 	}
-
-	startTime := time.Now()
-	totalRecords := len(coupons)
-	log.Printf("Starting optimized bulk insert of %d records...", totalRecords)
-
-	const batchSize = 10000 
-	db := m.dbp.MongoClient.Database("foodie")
-	collection := db.Collection(couponCollection)
-
-	documents := make([]interface{}, 0, batchSize)
-	insertedCount := 0
-	totalBatches := (totalRecords + batchSize - 1) / batchSize
-	currentBatchNum := 0
-	lastProgressUpdate := time.Now()
-	lastProgressPercentage := 0.0
-
-	for _, coupon := range coupons { 
-	    coupon.ID = primitive.NewObjectID().Hex()
-        documents = append(documents, coupon) 
-
-        insertedCount++
-
-        if len(documents) >= batchSize || insertedCount == totalRecords {
-            batchStartTime := time.Now()
-            currentBatchNum++
-
-            if len(documents) > 0 { 
-                opts := options.InsertMany().SetOrdered(false) 
-                var insertErr error
-                for retries := 0; retries < 3; retries++ { 
-                    _, insertErr = collection.InsertMany(ctx, documents, opts)
-                    if insertErr == nil {
-                        break 
-                    }
-                    log.Printf("Retry %d for batch %d/%d (%d docs) due to error: %v",
-                        retries+1, currentBatchNum, totalBatches, len(documents), insertErr)
-                    time.Sleep(time.Second * time.Duration(retries+1))
-                }
-                if insertErr != nil {
-                    return fmt.Errorf("bulk insert failed at batch %d/%d after retries (%d documents): %v",
-                        currentBatchNum, totalBatches, len(documents), insertErr)
-                }
-            }
-
-            currentProgressPercentage := float64(insertedCount) / float64(totalRecords) * 100
-            if currentProgressPercentage-lastProgressPercentage >= 5.0 || time.Since(lastProgressUpdate) >= 5*time.Second {
-                batchDuration := time.Since(batchStartTime)
-                log.Printf("Inserted batch %d/%d (%.2f%%) - %d documents in %v",
-                    currentBatchNum, totalBatches, currentProgressPercentage, len(documents), batchDuration)
-                lastProgressPercentage = currentProgressPercentage
-                lastProgressUpdate = time.Now()
-            }
-
-            documents = documents[:0]
-        }
-    }
-
-	totalDuration := time.Since(startTime)
-	log.Printf("Completed optimized bulk insert of %d codes in %v", insertedCount, totalDuration)
 	return nil
 }
 
@@ -184,30 +194,141 @@ func (m *CouponModel) GetCouponCount(ctx context.Context, code string) (int, err
 	return coupon.Appearances, nil
 }
 
-func (m *CouponModel) ValidateCoupon(ctx context.Context, code string) (bool, error) {
+// GetCoupon returns the coupon with the given code, or mongo.ErrNoDocuments
+func (m *CouponModel) GetCoupon(ctx context.Context, code string) (*Coupon, error) {
 	var coupon Coupon
 	db := m.dbp.MongoClient.Database("foodie")
 	err := db.Collection(couponCollection).FindOne(ctx, bson.M{"code": code}).Decode(&coupon)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return false, nil
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+func (m *CouponModel) InsertCoupon(ctx context.Context, coupon *Coupon) error {
+	db := m.dbp.MongoClient.Database("foodie")
+
+	now := time.Now()
+	coupon.ID = primitive.NewObjectID().Hex()
+	coupon.CreatedAt = &now
+	coupon.UpdatedAt = &now
+	_, err := db.Collection(couponCollection).InsertOne(ctx, coupon)
+	return err
+}
+
+// InsertGeneratedCoupons inserts coupons without stopping at codes that are
+// already taken. It returns the indexes of the coupons that were not inserted
+// because their code exists.
+func (m *CouponModel) InsertGeneratedCoupons(ctx context.Context, coupons []Coupon) ([]int, error) {
+	db := m.dbp.MongoClient.Database("foodie")
+
+	now := time.Now()
+	documents := make([]interface{}, len(coupons))
+	for i := range coupons {
+		coupons[i].ID = primitive.NewObjectID().Hex()
+		coupons[i].CreatedAt = &now
+		coupons[i].UpdatedAt = &now
+		documents[i] = coupons[i]
+	}
+
+	_, err := db.Collection(couponCollection).InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		var duplicates []int
+		for _, writeErr := range bulkErr.WriteErrors {
+			if !mongo.IsDuplicateKeyError(writeErr) {
+				return nil, err
+			}
+			duplicates = append(duplicates, writeErr.Index)
 		}
-		return false, fmt.Errorf("failed to get coupon: %v", err)
+		return duplicates, nil
 	}
-	return coupon.Appearances >= 2, nil
+	return nil, err
 }
 
-func (m *CouponModel) FetchCoupons() ([]Coupon, error) {
-	var coupons []Coupon
+// UpdateCoupon sets and unsets fields of a coupon and returns it as it is
+// after the update
+func (m *CouponModel) UpdateCoupon(ctx context.Context, code string, set bson.M, unset ...string) (*Coupon, error) {
 	db := m.dbp.MongoClient.Database("foodie")
-	cursor, err := db.Collection(couponCollection).Find(context.TODO(), bson.M{})
+
+	set["updatedAt"] = time.Now()
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		fields := bson.M{}
+		for _, field := range unset {
+			fields[field] = ""
+		}
+		update["$unset"] = fields
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var coupon Coupon
+	err := db.Collection(couponCollection).FindOneAndUpdate(ctx, bson.M{"code": code}, update, opts).Decode(&coupon)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch coupons: %v", err)
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// ListCoupons returns up to query.Limit coupons matching query, ordered by
+// code. Paging continues after query.After so each page is a range scan of the
+// code index, however many coupons there are.
+func (m *CouponModel) ListCoupons(ctx context.Context, query types.CouponQuery) ([]Coupon, error) {
+	collection := m.dbp.MongoClient.Database("foodie").Collection(couponCollection)
+
+	filters := bson.A{}
+	codeFilter := bson.M{}
+	if query.Prefix != "" {
+		codeFilter["$regex"] = "^" + regexp.QuoteMeta(query.Prefix)
+	}
+	if query.After != "" {
+		codeFilter["$gt"] = query.After
+	}
+	if len(codeFilter) > 0 {
+		filters = append(filters, bson.M{"code": codeFilter})
+	}
+
+	switch query.Type {
+	case "":
+	case types.CouponTypeLegacy:
+		filters = append(filters, bson.M{"type": bson.M{"$exists": false}})
+	default:
+		filters = append(filters, bson.M{"type": query.Type})
 	}
-	defer cursor.Close(context.TODO())
 
-	err = cursor.All(context.TODO(), &coupons)
+	// Mirrors Coupon.IsActive
+	if query.Active != nil {
+		active := bson.M{
+			"active": bson.M{"$ne": false},
+			"$or": bson.A{
+				bson.M{"type": bson.M{"$exists": true}},
+				bson.M{"appearances": bson.M{"$gte": 2}},
+			},
+		}
+		if *query.Active {
+			filters = append(filters, active)
+		} else {
+			filters = append(filters, bson.M{"$nor": bson.A{active}})
+		}
+	}
+
+	filter := bson.M{}
+	if len(filters) > 0 {
+		filter["$and"] = filters
+	}
+	findOptions := options.Find().
+		SetSort(bson.M{"code": 1}).
+		SetLimit(int64(query.Limit)).
+		SetProjection(bson.M{"fileList": 0})
+
+	cursor, err := collection.Find(ctx, filter, findOptions)
 	if err != nil {
+		return nil, fmt.Errorf("failed to list coupons: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	coupons := []Coupon{}
+	if err := cursor.All(ctx, &coupons); err != nil {
 		return nil, fmt.Errorf("failed to decode coupons: %v", err)
 	}
 	return coupons, nil
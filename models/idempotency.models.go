@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"foodie-service/config"
+	"foodie-service/database"
+	"foodie-service/types"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// IdempotencyRecord remembers the outcome of a POST /orders call made with an
+// Idempotency-Key header. Response stays empty while the original request is
+// still being processed.
+type IdempotencyRecord struct {
+	ID          string                 `json:"_id" bson:"_id"`
+	Key         string                 `json:"key" bson:"key"`
+	UserID      string                 `json:"userId" bson:"userId"`
+	RequestHash string                 `json:"requestHash" bson:"requestHash"`
+	Response    *types.PurchaseDetails `json:"response,omitempty" bson:"response,omitempty"`
+	CreatedAt   time.Time              `json:"createdAt" bson:"createdAt"`
+	CompletedAt *time.Time             `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
+
+type IdempotencyModel struct {
+	dbp *database.Mongo
+	dbs *database.Mongo
+}
+
+func (im *IdempotencyModel) createIndexes() error {
+	indexModels := []mongo.IndexModel{
+		{
+			// Keys are scoped to the user that sent them
+			Keys:    bson.D{{Key: "key", Value: 1}, {Key: "userId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"createdAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(config.GetConfig().IdempotencyKeyTTL.Seconds())),
+		},
+	}
+	for _, model := range indexModels {
+		_, err := im.collection().Indexes().CreateOne(context.TODO(), model)
+		if err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
+}
+
+func NewIdempotencyModel(dbp *database.Mongo, dbs *database.Mongo) *IdempotencyModel {
+	im := &IdempotencyModel{dbp: dbp, dbs: dbs}
+
+	if err := im.createIndexes(); err != nil {
+		panic(fmt.Sprintf("failed to create idempotency indexes: %v", err))
+	}
+	return im
+}
+
+func (im *IdempotencyModel) collection() *mongo.Collection {
+	return im.dbp.MongoClient.Database("foodie").Collection("idempotency_keys")
+}
+
+// Reserve claims key for userID. When the key was already claimed the existing
+// record is returned with created set to false.
+func (im *IdempotencyModel) Reserve(key string, userID string, requestHash string) (record *IdempotencyRecord, created bool, err error) {
+	record = &IdempotencyRecord{
+		ID:          bson.NewObjectID().Hex(),
+		Key:         key,
+		UserID:      userID,
+		RequestHash: requestHash,
+		CreatedAt:   time.Now(),
+	}
+	_, err = im.collection().InsertOne(context.TODO(), record)
+	if err == nil {
+		return record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, false, err
+	}
+
+	var existing IdempotencyRecord
+	err = im.collection().FindOne(context.TODO(), bson.M{"key": key, "userId": userID}).Decode(&existing)
+	if err != nil {
+		return nil, false, err
+	}
+	return &existing, false, nil
+}
+
+// Complete stores the response the key should replay from now on. ctx carries
+// the transaction the order is stored in.
+func (im *IdempotencyModel) Complete(ctx context.Context, key string, userID string, response *types.PurchaseDetails) error {
+	_, err := im.collection().UpdateOne(ctx,
+		bson.M{"key": key, "userId": userID},
+		bson.M{"$set": bson.M{"response": response, "completedAt": time.Now()}},
+	)
+	return err
+}
+
+// Release drops an unfinished reservation so the request can be retried
+func (im *IdempotencyModel) Release(key string, userID string) error {
+	_, err := im.collection().DeleteOne(context.TODO(), bson.M{
+		"key":      key,
+		"userId":   userID,
+		"response": bson.M{"$exists": false},
+	})
+	return err
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"foodie-service/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	loginAttemptsCollection = "login_attempts"
+	loginAuditCollection    = "login_audit"
+)
+
+// LoginAttemptSchema counts recent failed logins for one key, such as an email
+// address or a client IP. The document expires once the failures are old
+// enough to be forgotten.
+type LoginAttemptSchema struct {
+	Key           string     `json:"key" bson:"_id"`
+	Failures      int        `json:"failures" bson:"failures"`
+	LastFailureAt time.Time  `json:"lastFailureAt" bson:"lastFailureAt"`
+	LockedUntil   *time.Time `json:"lockedUntil,omitempty" bson:"lockedUntil,omitempty"`
+	ExpiresAt     time.Time  `json:"expiresAt" bson:"expiresAt"`
+}
+
+// LoginAuditSchema records a rejected login
+type LoginAuditSchema struct {
+	ID        string    `json:"_id" bson:"_id"`
+	Email     string    `json:"email" bson:"email"`
+	IP        string    `json:"ip" bson:"ip"`
+	UserAgent string    `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	Reason    string    `json:"reason" bson:"reason"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+type LoginAttemptsModel struct {
+	dbp *database.Mongo
+	dbs *database.Mongo
+}
+
+func (lm *LoginAttemptsModel) createIndexes() error {
+	db := lm.dbp.MongoClient.Database("foodie")
+
+	indexes := map[string][]mongo.IndexModel{
+		loginAttemptsCollection: {
+			{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		loginAuditCollection: {
+			{Keys: bson.D{{Key: "email", Value: 1}, {Key: "createdAt", Value: -1}}},
+			{Keys: bson.D{{Key: "ip", Value: 1}, {Key: "createdAt", Value: -1}}},
+		},
+	}
+	for collection, models := range indexes {
+		for _, model := range models {
+			if _, err := db.Collection(collection).Indexes().CreateOne(context.TODO(), model); err != nil {
+				return fmt.Errorf("failed to create index on %s: %w", collection, err)
+			}
+		}
+	}
+	return nil
+}
+
+func NewLoginAttemptsModel(dbp *database.Mongo, dbs *database.Mongo) *LoginAttemptsModel {
+	lm := &LoginAttemptsModel{dbp: dbp, dbs: dbs}
+
+	if err := lm.createIndexes(); err != nil {
+		panic(fmt.Sprintf("failed to create login attempt indexes: %v", err))
+	}
+	return lm
+}
+
+func (lm *LoginAttemptsModel) attempts() *mongo.Collection {
+	return lm.dbp.MongoClient.Database("foodie").Collection(loginAttemptsCollection)
+}
+
+// GetLoginAttempt returns the failures recorded for key, or nil when there are
+// none
+func (lm *LoginAttemptsModel) GetLoginAttempt(key string) (*LoginAttemptSchema, error) {
+	var attempt LoginAttemptSchema
+	err := lm.attempts().FindOne(context.TODO(), bson.M{"_id": key}).Decode(&attempt)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// ReserveLoginAttempt counts a login attempt for key as a failure before its
+// password is checked, so that concurrent attempts each get their own count.
+// It returns what was recorded before this attempt, or nil when nothing was,
+// and the failures including this attempt. Failures older than window are
+// forgotten, even if the TTL monitor has not removed them yet, and a lock is
+// kept until it ends.
+func (lm *LoginAttemptsModel) ReserveLoginAttempt(key string, window time.Duration) (*LoginAttemptSchema, int, error) {
+	// Dates are stored to the millisecond, so now is too, to compare the
+	// previous expiry the same way the update does
+	now := time.Now().Truncate(time.Millisecond)
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "failures", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$gt", Value: bson.A{"$expiresAt", now}}},
+				bson.D{{Key: "$add", Value: bson.A{"$failures", 1}}},
+				1,
+			}}}},
+			{Key: "lastFailureAt", Value: now},
+			{Key: "expiresAt", Value: bson.D{{Key: "$max", Value: bson.A{now.Add(window), "$lockedUntil"}}}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	var previous LoginAttemptSchema
+	err := lm.attempts().FindOneAndUpdate(context.TODO(), bson.M{"_id": key}, update, opts).Decode(&previous)
+	if err == mongo.ErrNoDocuments {
+		return nil, 1, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if !previous.ExpiresAt.After(now) {
+		return &previous, 1, nil
+	}
+	return &previous, previous.Failures + 1, nil
+}
+
+// ReleaseLoginAttempt takes back an attempt reserved for key that did not fail
+func (lm *LoginAttemptsModel) ReleaseLoginAttempt(key string) error {
+	_, err := lm.attempts().UpdateOne(context.TODO(),
+		bson.M{"_id": key, "failures": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"failures": -1}},
+	)
+	return err
+}
+
+// LockLogin blocks key until the given time. The failure count starts again
+// once the lock ends.
+func (lm *LoginAttemptsModel) LockLogin(key string, until time.Time) error {
+	_, err := lm.attempts().UpdateOne(context.TODO(),
+		bson.M{"_id": key},
+		bson.M{"$set": bson.M{"failures": 0, "lockedUntil": until, "expiresAt": until}},
+	)
+	return err
+}
+
+func (lm *LoginAttemptsModel) ClearLoginAttempts(key string) error {
+	_, err := lm.attempts().DeleteOne(context.TODO(), bson.M{"_id": key})
+	return err
+}
+
+func (lm *LoginAttemptsModel) InsertLoginAudit(audit *LoginAuditSchema) error {
+	audit.ID = bson.NewObjectID().Hex()
+	audit.CreatedAt = time.Now()
+
+	_, err := lm.dbp.MongoClient.Database("foodie").Collection(loginAuditCollection).InsertOne(context.TODO(), audit)
+	return err
+}
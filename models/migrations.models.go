@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"foodie-service/database"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// userReference is a field that holds the identifier from a user's token.
+// Before tokens carried the user's uuid that identifier was the email address.
+type userReference struct {
+	collection string
+	field      string
+	// arrayField is set when field is inside an array of documents
+	arrayField string
+}
+
+var userReferences = []userReference{
+	{collection: "orders", field: "userId"},
+	{collection: "orders", field: "changedBy", arrayField: "statusHistory"},
+	{collection: "orders", field: "cancellation.cancelledBy"},
+	{collection: "carts", field: "userId"},
+	{collection: "idempotency_keys", field: "userId"},
+	{collection: refreshTokensCollection, field: "userId"},
+	{collection: couponRedemptionsCollection, field: "userId"},
+}
+
+// UserIDMigrationResult counts the documents rewritten in one collection field
+type UserIDMigrationResult struct {
+	Collection string
+	Field      string
+	Emails     int
+	Updated    int64
+	// Unknown lists emails that no longer belong to any user and were left
+	// unchanged
+	Unknown []string
+	// Conflicts lists emails whose documents could not be moved because the
+	// user already has one under their uuid, such as a cart
+	Conflicts []string
+}
+
+// MigrateUserIDs rewrites every reference to a user by email address into a
+// reference by the user's uuid. It only touches values containing "@", so it
+// can be run again safely. With dryRun nothing is written.
+func MigrateUserIDs(ctx context.Context, db *database.Mongo, dryRun bool) ([]UserIDMigrationResult, error) {
+	foodie := db.MongoClient.Database("foodie")
+	userIDs := map[string]string{}
+
+	lookup := func(email string) (string, error) {
+		if userID, ok := userIDs[email]; ok {
+			return userID, nil
+		}
+		var user UserSchema
+		err := foodie.Collection("users").FindOne(ctx, bson.M{"email": email},
+			options.FindOne().SetProjection(bson.M{"userId": 1})).Decode(&user)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return "", err
+		}
+		userIDs[email] = user.UserID
+		return user.UserID, nil
+	}
+
+	var results []UserIDMigrationResult
+	for _, ref := range userReferences {
+		collection := foodie.Collection(ref.collection)
+		path := ref.field
+		if ref.arrayField != "" {
+			path = ref.arrayField + "." + ref.field
+		}
+
+		var emails []string
+		err := collection.Distinct(ctx, path, bson.M{path: bson.M{"$regex": "@"}}).Decode(&emails)
+		if err != nil {
+			return results, fmt.Errorf("failed to list %s.%s: %w", ref.collection, path, err)
+		}
+
+		result := UserIDMigrationResult{Collection: ref.collection, Field: path, Emails: len(emails)}
+		for _, email := range emails {
+			userID, err := lookup(email)
+			if err != nil {
+				return results, err
+			}
+			if userID == "" {
+				result.Unknown = append(result.Unknown, email)
+				continue
+			}
+
+			filter := bson.M{path: email}
+			if dryRun {
+				count, err := collection.CountDocuments(ctx, filter)
+				if err != nil {
+					return results, err
+				}
+				result.Updated += count
+				continue
+			}
+
+			var update bson.M
+			opts := options.UpdateMany()
+			if ref.arrayField != "" {
+				update = bson.M{"$set": bson.M{ref.arrayField + ".$[entry]." + ref.field: userID}}
+				opts.SetArrayFilters([]interface{}{bson.M{"entry." + ref.field: email}})
+			} else {
+				update = bson.M{"$set": bson.M{path: userID}}
+			}
+
+			updated, err := collection.UpdateMany(ctx, filter, update, opts)
+			if mongo.IsDuplicateKeyError(err) {
+				result.Conflicts = append(result.Conflicts, email)
+				continue
+			}
+			if err != nil {
+				return results, fmt.Errorf("failed to update %s.%s for %s: %w", ref.collection, path, email, err)
+			}
+			result.Updated += updated.ModifiedCount
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
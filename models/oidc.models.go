@@ -0,0 +1,69 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"foodie-service/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const oidcStatesCollection = "oidc_states"
+
+// OIDCStateSchema holds what is needed to finish a social login started at
+// an identity provider. State is the random value sent to the provider and
+// returned on the callback.
+type OIDCStateSchema struct {
+	State        string    `json:"state" bson:"_id"`
+	Provider     string    `json:"provider" bson:"provider"`
+	Nonce        string    `json:"nonce" bson:"nonce"`
+	CodeVerifier string    `json:"codeVerifier" bson:"codeVerifier"`
+	ExpiresAt    time.Time `json:"expiresAt" bson:"expiresAt"`
+}
+
+type OIDCModel struct {
+	dbp *database.Mongo
+	dbs *database.Mongo
+}
+
+func (om *OIDCModel) createIndexes() error {
+	collection := om.dbp.MongoClient.Database("foodie").Collection(oidcStatesCollection)
+
+	model := mongo.IndexModel{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)}
+	if _, err := collection.Indexes().CreateOne(context.TODO(), model); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	return nil
+}
+
+func NewOIDCModel(dbp *database.Mongo, dbs *database.Mongo) *OIDCModel {
+	om := &OIDCModel{dbp: dbp, dbs: dbs}
+
+	if err := om.createIndexes(); err != nil {
+		panic(fmt.Sprintf("failed to create oidc indexes: %v", err))
+	}
+	return om
+}
+
+func (om *OIDCModel) InsertOIDCState(state *OIDCStateSchema) error {
+	collection := om.dbp.MongoClient.Database("foodie").Collection(oidcStatesCollection)
+
+	_, err := collection.InsertOne(context.TODO(), state)
+	return err
+}
+
+// ConsumeOIDCState removes and returns an unexpired state so each one can only
+// complete a single login. It returns mongo.ErrNoDocuments when there is none.
+func (om *OIDCModel) ConsumeOIDCState(state string) (*OIDCStateSchema, error) {
+	collection := om.dbp.MongoClient.Database("foodie").Collection(oidcStatesCollection)
+
+	var stored OIDCStateSchema
+	filter := bson.M{"_id": state, "expiresAt": bson.M{"$gt": time.Now()}}
+	if err := collection.FindOneAndDelete(context.TODO(), filter).Decode(&stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
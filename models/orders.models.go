@@ -13,17 +13,89 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
+// OrderStatusEvent is a single entry in an order's status history
+type OrderStatusEvent struct {
+	From      types.OrderStatus `json:"from,omitempty" bson:"from,omitempty"`
+	To        types.OrderStatus `json:"to" bson:"to"`
+	ChangedBy string            `json:"changedBy" bson:"changedBy"`
+	Note      string            `json:"note,omitempty" bson:"note,omitempty"`
+	ChangedAt time.Time         `json:"changedAt" bson:"changedAt"`
+}
+
+type OrderCancellation struct {
+	Reason      string    `json:"reason" bson:"reason"`
+	CancelledBy string    `json:"cancelledBy" bson:"cancelledBy"`
+	CancelledAt time.Time `json:"cancelledAt" bson:"cancelledAt"`
+}
+
+// OrderRefund records the money and coupon owed back to the customer once an
+// order is cancelled
+type OrderRefund struct {
+	Amount         float64            `json:"amount" bson:"amount"`
+	CouponCode     string             `json:"couponCode,omitempty" bson:"couponCode,omitempty"`
+	CouponReleased bool               `json:"couponReleased" bson:"couponReleased"`
+	Status         types.RefundStatus `json:"status" bson:"status"`
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+	CompletedAt    *time.Time         `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
+
 type OrderSchema struct {
-	ID         string        `json:"_id" bson:"_id"`
-	OrderID    string        `json:"orderId" bson:"orderId" unique:"true"`
-	UserID     string        `json:"userId" bson:"userId"`
-	Items      []types.Order `json:"items" bson:"items"`
-	TotalPrice float64       `json:"totalPrice" bson:"totalPrice"`
-	Discount   float64       `json:"discount" bson:"discount"`
-	FinalPrice float64       `json:"finalPrice" bson:"finalPrice"`
-	CouponCode string        `json:"couponCode" bson:"couponCode"`
-	InsertedAt time.Time     `json:"insertedAt" bson:"insertedAt"`
-	UpdatedAt  time.Time     `json:"updatedAt" bson:"updatedAt"`
+	ID              string             `json:"_id" bson:"_id"`
+	OrderID         string             `json:"orderId" bson:"orderId" unique:"true"`
+	UserID          string             `json:"userId" bson:"userId"`
+	Items           []types.LineItem   `json:"items" bson:"items"`
+	TotalPrice      float64            `json:"totalPrice" bson:"totalPrice"`
+	Discount        float64            `json:"discount" bson:"discount"`
+	FinalPrice      float64            `json:"finalPrice" bson:"finalPrice"`
+	CouponCode      string             `json:"couponCode" bson:"couponCode"`
+	DeliveryAddress *Address           `json:"deliveryAddress,omitempty" bson:"deliveryAddress,omitempty"`
+	Status          types.OrderStatus  `json:"status" bson:"status"`
+	StatusHistory   []OrderStatusEvent `json:"statusHistory" bson:"statusHistory"`
+	Cancellation    *OrderCancellation `json:"cancellation,omitempty" bson:"cancellation,omitempty"`
+	Refund          *OrderRefund       `json:"refund,omitempty" bson:"refund,omitempty"`
+	InsertedAt      time.Time          `json:"insertedAt" bson:"insertedAt"`
+	UpdatedAt       time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// CurrentStatus returns the order status, treating orders stored before the
+// lifecycle was introduced as placed
+func (o *OrderSchema) CurrentStatus() types.OrderStatus {
+	if o.Status == "" {
+		return types.OrderStatusPlaced
+	}
+	return o.Status
+}
+
+func (o *OrderSchema) ToPurchaseDetails() *types.PurchaseDetails {
+	history := make([]types.StatusChange, len(o.StatusHistory))
+	for i, event := range o.StatusHistory {
+		history[i] = types.StatusChange(event)
+	}
+	details := &types.PurchaseDetails{
+		OrderID:       o.OrderID,
+		Items:         o.Items,
+		TotalPrice:    o.TotalPrice,
+		Discount:      o.Discount,
+		FinalPrice:    o.FinalPrice,
+		CouponCode:    o.CouponCode,
+		Status:        o.CurrentStatus(),
+		StatusHistory: history,
+		CreatedAt:     o.InsertedAt,
+		UpdatedAt:     o.UpdatedAt,
+	}
+	if o.DeliveryAddress != nil {
+		address := types.Address(*o.DeliveryAddress)
+		details.DeliveryAddress = &address
+	}
+	if o.Cancellation != nil {
+		cancellation := types.Cancellation(*o.Cancellation)
+		details.Cancellation = &cancellation
+	}
+	if o.Refund != nil {
+		refund := types.Refund(*o.Refund)
+		details.Refund = &refund
+	}
+	return details
 }
 
 type OrdersModel struct {
@@ -44,6 +116,10 @@ func (om *OrdersModel) createUniqueIndex() error {
 			Keys:    bson.M{"userId": 1},
 			Options: options.Index(),
 		},
+		{
+			Keys:    bson.M{"status": 1},
+			Options: options.Index(),
+		},
 	}
 	// Create all indexes
 	for _, model := range indexModels {
@@ -87,10 +163,11 @@ func (om *OrdersModel) GetOrders(userID string, limit, offset int) ([]OrderSchem
 	return orderSchemas, nil
 }
 
-func (om *OrdersModel) InsertOrder(order *types.PurchaseDetails, userID string) (*types.PurchaseDetails, error) {
+func (om *OrdersModel) InsertOrder(ctx context.Context, order *types.PurchaseDetails, userID string) (*types.PurchaseDetails, error) {
 	db := om.dbp
 	collection := db.MongoClient.Database("foodie").Collection("orders")
 
+	now := time.Now()
 	orderSchema := &OrderSchema{
 		ID:         primitive.NewObjectID().Hex(),
 		OrderID:    order.OrderID,
@@ -100,23 +177,90 @@ func (om *OrdersModel) InsertOrder(order *types.PurchaseDetails, userID string)
 		Discount:   float64(order.Discount),
 		FinalPrice: float64(order.FinalPrice),
 		CouponCode: order.CouponCode,
-		InsertedAt: time.Now(),
-		UpdatedAt:  time.Now(),
+		Status:     types.OrderStatusPlaced,
+		StatusHistory: []OrderStatusEvent{
+			{To: types.OrderStatusPlaced, ChangedBy: userID, ChangedAt: now},
+		},
+		InsertedAt: now,
+		UpdatedAt:  now,
+	}
+	if order.DeliveryAddress != nil {
+		address := Address(*order.DeliveryAddress)
+		orderSchema.DeliveryAddress = &address
 	}
 
-	_, err := collection.InsertOne(context.TODO(), orderSchema)
+	_, err := collection.InsertOne(ctx, orderSchema)
 	if err != nil {
 		return nil, err
 	}
 
-	return &types.PurchaseDetails{
-		OrderID:    orderSchema.OrderID,
-		Items:      orderSchema.Items,
-		TotalPrice: float64(orderSchema.TotalPrice),
-		Discount:   float64(orderSchema.Discount),
-		FinalPrice: float64(orderSchema.FinalPrice),
-		CouponCode: orderSchema.CouponCode,
-		CreatedAt:  orderSchema.InsertedAt,
-		UpdatedAt:  orderSchema.UpdatedAt,
-	}, nil
+	return orderSchema.ToPurchaseDetails(), nil
+}
+
+func (om *OrdersModel) GetOrderByOrderId(orderID string) (*OrderSchema, error) {
+	collection := om.dbp.MongoClient.Database("foodie").Collection("orders")
+
+	var order OrderSchema
+	err := collection.FindOne(context.TODO(), bson.M{"orderId": orderID}).Decode(&order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetUserOrder looks an order up by its orderId, only matching when it belongs
+// to userID
+func (om *OrdersModel) GetUserOrder(orderID string, userID string) (*OrderSchema, error) {
+	collection := om.dbp.MongoClient.Database("foodie").Collection("orders")
+
+	var order OrderSchema
+	err := collection.FindOne(context.TODO(), bson.M{"orderId": orderID, "userId": userID}).Decode(&order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// UpdateOrderStatus moves an order from one status to another and appends the
+// change to its history, setting any extra fields alongside. The update only
+// matches while the order is still in the expected status, so concurrent
+// transitions cannot both succeed; in that case mongo.ErrNoDocuments is
+// returned.
+func (om *OrdersModel) UpdateOrderStatus(ctx context.Context, orderID string, from types.OrderStatus, event OrderStatusEvent, fields bson.M) (*OrderSchema, error) {
+	return om.updateOrderStatus(ctx, bson.M{"orderId": orderID}, from, event, fields)
+}
+
+// CancelOrder cancels an order owned by userID, storing the cancellation and
+// refund records in the same update as the status change
+func (om *OrdersModel) CancelOrder(ctx context.Context, orderID string, userID string, from types.OrderStatus, event OrderStatusEvent, cancellation *OrderCancellation, refund *OrderRefund) (*OrderSchema, error) {
+	fields := bson.M{"cancellation": cancellation, "refund": refund}
+	return om.updateOrderStatus(ctx, bson.M{"orderId": orderID, "userId": userID}, from, event, fields)
+}
+
+func (om *OrdersModel) updateOrderStatus(ctx context.Context, filter bson.M, from types.OrderStatus, event OrderStatusEvent, fields bson.M) (*OrderSchema, error) {
+	collection := om.dbp.MongoClient.Database("foodie").Collection("orders")
+
+	statusFilter := interface{}(from)
+	if from == types.OrderStatusPlaced {
+		// Orders created before the lifecycle existed have no status field
+		statusFilter = bson.M{"$in": []interface{}{from, nil}}
+	}
+	filter["status"] = statusFilter
+
+	set := bson.M{"status": event.To, "updatedAt": event.ChangedAt}
+	for field, value := range fields {
+		set[field] = value
+	}
+	update := bson.M{
+		"$set":  set,
+		"$push": bson.M{"statusHistory": event},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var order OrderSchema
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
 }
@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"foodie-service/database"
 	"foodie-service/types"
+	"regexp"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
@@ -35,15 +35,33 @@ type Image struct {
 	Desktop   string `json:"desktop" bson:"desktop"`
 }
 
+// Product is a catalogue entry. Stock is the number of units left; products
+// without it are not stock-tracked. Archived products are retired from the
+// catalogue but kept so past orders still resolve.
 type Product struct {
-	ID         string    `json:"_id" bson:"_id"`
-	ProductID  string    `json:"productId" bson:"productId" unique:"true"`
-	Image      Image     `json:"image" bson:"image"`
-	Name       string    `json:"name" bson:"name"`
-	Category   string    `json:"category" bson:"category"`
-	Price      float64   `json:"price" bson:"price"`
-	InsertedAt time.Time `json:"insertedAt" bson:"insertedAt"`
-	UpdatedAt  time.Time `json:"updatedAt" bson:"updatedAt"`
+	ID         string     `json:"_id" bson:"_id"`
+	ProductID  string     `json:"productId" bson:"productId" unique:"true"`
+	Image      Image      `json:"image" bson:"image"`
+	Name       string     `json:"name" bson:"name"`
+	Category   string     `json:"category" bson:"category"`
+	Price      float64    `json:"price" bson:"price"`
+	Stock      *int       `json:"stock,omitempty" bson:"stock,omitempty"`
+	Archived   bool       `json:"archived" bson:"archived"`
+	ArchivedAt *time.Time `json:"archivedAt,omitempty" bson:"archivedAt,omitempty"`
+	InsertedAt time.Time  `json:"insertedAt" bson:"insertedAt"`
+	UpdatedAt  time.Time  `json:"updatedAt" bson:"updatedAt"`
+}
+
+func (p *Product) ToProduct() types.Product {
+	return types.Product{
+		ProductID: p.ProductID,
+		Image:     types.Image(p.Image),
+		Name:      p.Name,
+		Category:  p.Category,
+		Price:     p.Price,
+		Stock:     p.Stock,
+		Archived:  p.Archived,
+	}
 }
 
 type ProductsModel struct {
@@ -51,31 +69,55 @@ type ProductsModel struct {
 	dbs *database.Mongo
 }
 
-func (pm *ProductsModel) createUniqueIndex() error {
+func (pm *ProductsModel) createIndexes() error {
 	collection := pm.dbp.MongoClient.Database("foodie").Collection("products")
 
-	// Create a unique index on productId
-	indexModel := mongo.IndexModel{
-		Keys: bson.M{
-			"productId": 1,
+	indexModels := []mongo.IndexModel{
+		{
+			// Create a unique index on productId
+			Keys:    bson.M{"productId": 1},
+			Options: options.Index().SetUnique(true),
 		},
-		Options: options.Index().SetUnique(true),
+		// Catalogue filtering and sorting
+		{Keys: bson.D{{Key: "category", Value: 1}, {Key: "price", Value: 1}}},
+		{Keys: bson.M{"price": 1}},
+		{Keys: bson.M{"name": 1}},
+		{Keys: bson.M{"insertedAt": -1}},
 	}
 
-	_, err := collection.Indexes().CreateOne(context.TODO(), indexModel)
-	return err
+	for _, model := range indexModels {
+		if _, err := collection.Indexes().CreateOne(context.TODO(), model); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
 }
 
 func NewProductsModel(dbp *database.Mongo, dbs *database.Mongo) *ProductsModel {
 	pm := &ProductsModel{dbp: dbp, dbs: dbs}
 
-	if err := pm.createUniqueIndex(); err != nil {
-		panic(fmt.Sprintf("failed to create unique index: %v", err))
+	if err := pm.createIndexes(); err != nil {
+		panic(fmt.Sprintf("failed to create product indexes: %v", err))
 	}
 	return pm
 }
 
-func (pm *ProductsModel) GetProducts(readFromPrimary bool) ([]types.Product, error) {
+var productSorts = map[string]bson.D{
+	types.ProductSortPriceAsc:  {{Key: "price", Value: 1}},
+	types.ProductSortPriceDesc: {{Key: "price", Value: -1}},
+	types.ProductSortNameAsc:   {{Key: "name", Value: 1}},
+	types.ProductSortNameDesc:  {{Key: "name", Value: -1}},
+	types.ProductSortNewest:    {{Key: "insertedAt", Value: -1}},
+}
+
+func IsValidProductSort(sort string) bool {
+	_, ok := productSorts[sort]
+	return ok || sort == ""
+}
+
+// GetProducts returns one page of the catalogue matching query along with the
+// total number of matching products
+func (pm *ProductsModel) GetProducts(readFromPrimary bool, query types.ProductQuery) ([]types.Product, int64, error) {
 	var db *database.Mongo
 
 	if readFromPrimary {
@@ -86,28 +128,56 @@ func (pm *ProductsModel) GetProducts(readFromPrimary bool) ([]types.Product, err
 
 	collection := db.MongoClient.Database("foodie").Collection("products")
 
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	filter := bson.M{}
+	if !query.IncludeArchived {
+		filter["archived"] = bson.M{"$ne": true}
+	}
+	if query.Category != "" {
+		filter["category"] = query.Category
+	}
+	priceFilter := bson.M{}
+	if query.MinPrice != nil {
+		priceFilter["$gte"] = *query.MinPrice
+	}
+	if query.MaxPrice != nil {
+		priceFilter["$lte"] = *query.MaxPrice
+	}
+	if len(priceFilter) > 0 {
+		filter["price"] = priceFilter
+	}
+	if query.Search != "" {
+		filter["name"] = bson.M{"$regex": regexp.QuoteMeta(query.Search), "$options": "i"}
+	}
+
+	total, err := collection.CountDocuments(context.TODO(), filter)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	// productId breaks ties so pages stay stable
+	sort := append(bson.D{}, productSorts[query.Sort]...)
+	sort = append(sort, bson.E{Key: "productId", Value: 1})
+	findOptions := options.Find().
+		SetSort(sort).
+		SetLimit(int64(query.Limit)).
+		SetSkip(int64(query.Offset))
+
+	cursor, err := collection.Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer cursor.Close(context.TODO())
 
 	var products []Product
 	if err = cursor.All(context.TODO(), &products); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	result := make([]types.Product, len(products))
 	for i, p := range products {
-		result[i] = types.Product{
-			ProductID: p.ProductID,
-			Image:     types.Image(p.Image),
-			Name:      p.Name,
-			Category:  p.Category,
-			Price:     p.Price,
-		}
+		result[i] = p.ToProduct()
 	}
 
-	return result, nil
+	return result, total, nil
 }
 
 func (pm *ProductsModel) GetProductByProductId(id string) (*types.Product, error) {
@@ -116,13 +186,40 @@ func (pm *ProductsModel) GetProductByProductId(id string) (*types.Product, error
 
 	filter := bson.M{"productId": id}
 
-	product := &types.Product{}
-	err := collection.FindOne(context.TODO(), filter).Decode(product)
+	var product Product
+	err := collection.FindOne(context.TODO(), filter).Decode(&product)
 	if err != nil {
 		return nil, err
 	}
 
-	return product, nil
+	result := product.ToProduct()
+	return &result, nil
+}
+
+// GetProductsByIds resolves many products with a single query, keyed by
+// productId. Ids that do not exist are simply absent from the result.
+func (pm *ProductsModel) GetProductsByIds(ids []string) (map[string]types.Product, error) {
+	result := make(map[string]types.Product, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	collection := pm.dbp.MongoClient.Database("foodie").Collection("products")
+
+	cursor, err := collection.Find(context.TODO(), bson.M{"productId": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var products []Product
+	if err = cursor.All(context.TODO(), &products); err != nil {
+		return nil, err
+	}
+	for _, p := range products {
+		result[p.ProductID] = p.ToProduct()
+	}
+	return result, nil
 }
 
 func (pm *ProductsModel) InsertBulkProducts(products []types.Product) error {
@@ -133,12 +230,13 @@ func (pm *ProductsModel) InsertBulkProducts(products []types.Product) error {
 	bulkWrite := make([]mongo.WriteModel, len(products))
 	for i, product := range products {
 		modelProduct := Product{
-			ID:         primitive.NewObjectID().Hex(),
+			ID:         bson.NewObjectID().Hex(),
 			ProductID:  product.ProductID,
 			Image:      Image(product.Image),
 			Name:       product.Name,
 			Category:   product.Category,
 			Price:      product.Price,
+			Stock:      product.Stock,
 			InsertedAt: time.Now(),
 			UpdatedAt:  time.Now(),
 		}
@@ -156,3 +254,65 @@ func (pm *ProductsModel) InsertBulkProducts(products []types.Product) error {
 
 	return nil
 }
+
+// ReserveStock takes quantity units of a stock-tracked product, returning false
+// without changing anything when fewer units are left
+func (pm *ProductsModel) ReserveStock(ctx context.Context, productID string, quantity int) (bool, error) {
+	collection := pm.dbp.MongoClient.Database("foodie").Collection("products")
+
+	filter := bson.M{"productId": productID, "stock": bson.M{"$gte": quantity}}
+	update := bson.M{
+		"$inc": bson.M{"stock": -quantity},
+		"$set": bson.M{"updatedAt": time.Now()},
+	}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// ReleaseStock puts quantity units back on a stock-tracked product
+func (pm *ProductsModel) ReleaseStock(ctx context.Context, productID string, quantity int) error {
+	collection := pm.dbp.MongoClient.Database("foodie").Collection("products")
+
+	filter := bson.M{"productId": productID, "stock": bson.M{"$exists": true}}
+	update := bson.M{
+		"$inc": bson.M{"stock": quantity},
+		"$set": bson.M{"updatedAt": time.Now()},
+	}
+	_, err := collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// UpdateProduct sets and unsets fields on a product, bumping UpdatedAt, and
+// returns the product as it is after the update
+func (pm *ProductsModel) UpdateProduct(productID string, set bson.M, unset ...string) (*types.Product, error) {
+	collection := pm.dbp.MongoClient.Database("foodie").Collection("products")
+
+	set["updatedAt"] = time.Now()
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		fields := bson.M{}
+		for _, field := range unset {
+			fields[field] = ""
+		}
+		update["$unset"] = fields
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var product Product
+	err := collection.FindOneAndUpdate(context.TODO(), bson.M{"productId": productID}, update, opts).Decode(&product)
+	if err != nil {
+		return nil, err
+	}
+
+	result := product.ToProduct()
+	return &result, nil
+}
+
+// ArchiveProduct soft deletes a product, hiding it from the catalogue while
+// keeping it for order history
+func (pm *ProductsModel) ArchiveProduct(productID string) (*types.Product, error) {
+	return pm.UpdateProduct(productID, bson.M{"archived": true, "archivedAt": time.Now()})
+}
@@ -0,0 +1,221 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"foodie-service/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	refreshTokensCollection = "refresh_tokens"
+	revokedTokensCollection = "revoked_tokens"
+)
+
+// OneTimeTokenPurpose names what a one-time token is for. Each purpose is kept
+// in its own collection.
+type OneTimeTokenPurpose string
+
+const (
+	PasswordResetToken     OneTimeTokenPurpose = "password_resets"
+	EmailVerificationToken OneTimeTokenPurpose = "email_verifications"
+)
+
+var oneTimeTokenPurposes = []OneTimeTokenPurpose{PasswordResetToken, EmailVerificationToken}
+
+// RefreshTokenSchema stores the hash of an opaque refresh token. Tokens that
+// descend from the same login share a FamilyID so the whole chain can be
+// revoked when a used token is presented again.
+type RefreshTokenSchema struct {
+	ID         string     `json:"_id" bson:"_id"`
+	TokenHash  string     `json:"tokenHash" bson:"tokenHash" unique:"true"`
+	UserID     string     `json:"userId" bson:"userId"`
+	FamilyID   string     `json:"familyId" bson:"familyId"`
+	ExpiresAt  time.Time  `json:"expiresAt" bson:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	ReplacedBy string     `json:"replacedBy,omitempty" bson:"replacedBy,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+// RevokedTokenSchema is a denylisted access token, kept until it would have
+// expired anyway
+type RevokedTokenSchema struct {
+	JTI       string    `json:"jti" bson:"_id"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+}
+
+// OneTimeTokenSchema stores the hash of a token that is emailed to a user and
+// can be used once before it expires
+type OneTimeTokenSchema struct {
+	ID        string     `json:"_id" bson:"_id"`
+	TokenHash string     `json:"tokenHash" bson:"tokenHash" unique:"true"`
+	UserID    string     `json:"userId" bson:"userId"`
+	ExpiresAt time.Time  `json:"expiresAt" bson:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty" bson:"usedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+type TokensModel struct {
+	dbp *database.Mongo
+	dbs *database.Mongo
+}
+
+func (tm *TokensModel) createIndexes() error {
+	db := tm.dbp.MongoClient.Database("foodie")
+
+	indexes := map[string][]mongo.IndexModel{
+		refreshTokensCollection: {
+			{Keys: bson.M{"tokenHash": 1}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.M{"familyId": 1}},
+			{Keys: bson.M{"userId": 1}},
+			{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		revokedTokensCollection: {
+			{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	}
+	for _, purpose := range oneTimeTokenPurposes {
+		indexes[string(purpose)] = []mongo.IndexModel{
+			{Keys: bson.M{"tokenHash": 1}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.M{"userId": 1}},
+			{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		}
+	}
+	for collection, models := range indexes {
+		for _, model := range models {
+			if _, err := db.Collection(collection).Indexes().CreateOne(context.TODO(), model); err != nil {
+				return fmt.Errorf("failed to create index on %s: %w", collection, err)
+			}
+		}
+	}
+	return nil
+}
+
+func NewTokensModel(dbp *database.Mongo, dbs *database.Mongo) *TokensModel {
+	tm := &TokensModel{dbp: dbp, dbs: dbs}
+
+	if err := tm.createIndexes(); err != nil {
+		panic(fmt.Sprintf("failed to create token indexes: %v", err))
+	}
+	return tm
+}
+
+func (tm *TokensModel) refreshTokens() *mongo.Collection {
+	return tm.dbp.MongoClient.Database("foodie").Collection(refreshTokensCollection)
+}
+
+func (tm *TokensModel) InsertRefreshToken(token *RefreshTokenSchema) error {
+	token.ID = bson.NewObjectID().Hex()
+	token.CreatedAt = time.Now()
+
+	_, err := tm.refreshTokens().InsertOne(context.TODO(), token)
+	return err
+}
+
+func (tm *TokensModel) GetRefreshToken(tokenHash string) (*RefreshTokenSchema, error) {
+	var token RefreshTokenSchema
+	err := tm.refreshTokens().FindOne(context.TODO(), bson.M{"tokenHash": tokenHash}).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// MarkRefreshTokenUsed revokes a refresh token as it is exchanged for
+// replacedBy. It returns false when the token had already been revoked, which
+// means it is being reused.
+func (tm *TokensModel) MarkRefreshTokenUsed(tokenHash string, replacedBy string) (bool, error) {
+	now := time.Now()
+	result, err := tm.refreshTokens().UpdateOne(context.TODO(),
+		bson.M{"tokenHash": tokenHash, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": now, "replacedBy": replacedBy}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (tm *TokensModel) RevokeRefreshTokenFamily(familyID string) error {
+	_, err := tm.refreshTokens().UpdateMany(context.TODO(),
+		bson.M{"familyId": familyID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	return err
+}
+
+func (tm *TokensModel) RevokeUserRefreshTokens(userID string) error {
+	_, err := tm.refreshTokens().UpdateMany(context.TODO(),
+		bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	return err
+}
+
+// RevokeAccessToken denylists an access token by its jti
+func (tm *TokensModel) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	collection := tm.dbp.MongoClient.Database("foodie").Collection(revokedTokensCollection)
+
+	_, err := collection.UpdateOne(context.TODO(),
+		bson.M{"_id": jti},
+		bson.M{"$set": bson.M{"expiresAt": expiresAt}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (tm *TokensModel) IsTokenRevoked(jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	collection := tm.dbp.MongoClient.Database("foodie").Collection(revokedTokensCollection)
+
+	count, err := collection.CountDocuments(context.TODO(), bson.M{"_id": jti}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (tm *TokensModel) oneTimeTokens(purpose OneTimeTokenPurpose) *mongo.Collection {
+	return tm.dbp.MongoClient.Database("foodie").Collection(string(purpose))
+}
+
+// InsertOneTimeToken stores a new token for purpose. Tokens previously issued
+// to the same user for the same purpose stop working.
+func (tm *TokensModel) InsertOneTimeToken(purpose OneTimeTokenPurpose, token *OneTimeTokenSchema) error {
+	collection := tm.oneTimeTokens(purpose)
+
+	_, err := collection.DeleteMany(context.TODO(), bson.M{"userId": token.UserID, "usedAt": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+
+	token.ID = bson.NewObjectID().Hex()
+	token.CreatedAt = time.Now()
+	_, err = collection.InsertOne(context.TODO(), token)
+	return err
+}
+
+// ConsumeOneTimeToken marks an unused, unexpired token as used and returns it.
+// It returns mongo.ErrNoDocuments when there is no such token.
+func (tm *TokensModel) ConsumeOneTimeToken(purpose OneTimeTokenPurpose, tokenHash string) (*OneTimeTokenSchema, error) {
+	now := time.Now()
+	filter := bson.M{
+		"tokenHash": tokenHash,
+		"usedAt":    bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": now},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var token OneTimeTokenSchema
+	err := tm.oneTimeTokens(purpose).FindOneAndUpdate(context.TODO(), filter, bson.M{"$set": bson.M{"usedAt": now}}, opts).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
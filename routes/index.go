@@ -2,6 +2,7 @@ package routes
 
 import (
 	"foodie-service/controllers"
+	"foodie-service/types"
 	"foodie-service/utils"
 
 	"github.com/gofiber/fiber/v2"
@@ -10,21 +11,71 @@ import (
 func SetupRoutes(app *fiber.App) {
 	controller := controllers.GetController()
 
+	requireAdmin := utils.RequireRole(types.RoleAdmin)
+	requireStaff := utils.RequireRole(types.RoleStaff, types.RoleAdmin)
+
 	api := app.Group("/")
 	// Public routes
-	api.Post("/products", controller.ProductsController.InsertBulkProducts)
 	api.Get("/products", controller.ProductsController.GetProducts)
 	api.Get("/products/:id", controller.ProductsController.GetProductById)
 
+	// Catalogue management
+	api.Post("/products", utils.ValidateToken(), requireAdmin, controller.ProductsController.InsertBulkProducts)
+	api.Put("/products/:id", utils.ValidateToken(), requireAdmin, controller.ProductsController.UpdateProduct)
+	api.Patch("/products/:id", utils.ValidateToken(), requireAdmin, controller.ProductsController.PatchProduct)
+	api.Delete("/products/:id", utils.ValidateToken(), requireAdmin, controller.ProductsController.DeleteProduct)
+
 	// Auth routes
 	api.Post("/auth/login", controller.AuthController.Login)
 	api.Post("/auth/signup", controller.AuthController.SignUp)
+	api.Post("/auth/refresh", controller.AuthController.Refresh)
+	api.Post("/auth/logout", utils.ValidateToken(), controller.AuthController.Logout)
+	api.Post("/auth/password/forgot", controller.AuthController.ForgotPassword)
+	api.Post("/auth/password/reset", controller.AuthController.ResetPassword)
+	api.Get("/auth/verify", controller.AuthController.VerifyEmail)
+	api.Post("/auth/verify/resend", utils.ValidateToken(), controller.AuthController.ResendVerification)
+	api.Get("/auth/oidc/:provider/login", controller.AuthController.OIDCLogin)
+	api.Get("/auth/oidc/:provider/callback", controller.AuthController.OIDCCallback)
+	api.Get("/.well-known/jwks.json", controller.AuthController.JWKS)
 
 	// Coupons routes
-	api.Get("/coupons", controller.OrdersController.FetchCoupons)
+	api.Get("/coupons/:code/check", controller.CouponsController.CheckCoupon)
 
 	// Protected routes
 	secured := api.Group("/orders", utils.ValidateToken())
 	secured.Post("/", controller.OrdersController.PlaceOrder)
 	secured.Get("/", controller.OrdersController.GetOrders)
+	secured.Get("/:orderId", controller.OrdersController.GetOrder)
+	secured.Patch("/:orderId/status", requireStaff, controller.OrdersController.UpdateOrderStatus)
+	secured.Post("/:orderId/cancel", controller.OrdersController.CancelOrder)
+
+	cart := api.Group("/cart", utils.ValidateToken())
+	cart.Get("/", controller.CartController.GetCart)
+	cart.Post("/", controller.CartController.AddItem)
+	cart.Patch("/", controller.CartController.UpdateItem)
+	cart.Delete("/", controller.CartController.ClearCart)
+	cart.Put("/coupon", controller.CartController.ApplyCoupon)
+	cart.Delete("/coupon", controller.CartController.RemoveCoupon)
+	cart.Post("/checkout", controller.CartController.Checkout)
+	cart.Delete("/:productId", controller.CartController.RemoveItem)
+
+	me := api.Group("/me", utils.ValidateToken())
+	me.Get("/", controller.UsersController.GetProfile)
+	me.Patch("/", controller.UsersController.UpdateProfile)
+	me.Get("/addresses", controller.UsersController.GetAddresses)
+	me.Post("/addresses", controller.UsersController.AddAddress)
+	me.Get("/addresses/:addressId", controller.UsersController.GetAddress)
+	me.Patch("/addresses/:addressId", controller.UsersController.UpdateAddress)
+	me.Delete("/addresses/:addressId", controller.UsersController.DeleteAddress)
+
+	// Admin routes
+	admin := api.Group("/admin", utils.ValidateToken(), requireAdmin)
+	admin.Patch("/users/:userId/role", controller.AuthController.UpdateUserRole)
+	admin.Get("/coupons", controller.CouponsController.ListCoupons)
+	// generate is registered before :code so it is not taken for a code
+	admin.Post("/coupons/generate", controller.CouponsController.GenerateCoupons)
+	admin.Get("/coupons/:code", controller.CouponsController.GetCoupon)
+	admin.Post("/coupons/:code", controller.CouponsController.CreateCoupon)
+	admin.Patch("/coupons/:code", controller.CouponsController.UpdateCoupon)
+	admin.Delete("/coupons/:code", controller.CouponsController.DeactivateCoupon)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"foodie-service/config"
 	"foodie-service/controllers"
 
 	// "foodie-service/coupons"
@@ -10,6 +11,8 @@ import (
 	"foodie-service/models"
 	"foodie-service/routes"
 	"foodie-service/services"
+	"foodie-service/utils"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -20,8 +23,20 @@ import (
 // CreateServer initializes and starts the Fiber server on port 3000
 func CreateServer(ctx context.Context) {
 
+	cfg := config.GetConfig()
+	if cfg.ProxyHeader != "" && len(cfg.TrustedProxies) == 0 {
+		// Without a trusted proxy list any client could set the header and
+		// pick the IP its failed logins are counted against
+		fmt.Println("PROXY_HEADER is set but TRUSTED_PROXIES is empty")
+		return
+	}
 	app := fiber.New(fiber.Config{
-		AppName: "Foodie Service v1.0.0",
+		AppName:                 "Foodie Service v1.0.0",
+		ProxyHeader:             cfg.ProxyHeader,
+		EnableTrustedProxyCheck: cfg.ProxyHeader != "",
+		TrustedProxies:          cfg.TrustedProxies,
+		// Headers listing several addresses resolve to the first valid one
+		EnableIPValidation: true,
 	})
 
 	// Add logger middleware
@@ -46,6 +61,16 @@ func CreateServer(ctx context.Context) {
 		return c.Next()
 	})
 
+	if err := services.CheckOrderConfig(); err != nil {
+		fmt.Printf("Invalid order configuration: %v\n", err)
+		return
+	}
+
+	if err := utils.LoadSigningKeys(); err != nil {
+		fmt.Printf("Failed to load token signing keys: %v\n", err)
+		return
+	}
+
 	mongoClientPrimary, err := database.MongoClient("primary")
 	if err != nil {
 		fmt.Println("Connection to primary mongo instance could not be established", err)
@@ -56,11 +81,18 @@ func CreateServer(ctx context.Context) {
 	}
 
 	models := models.NewBaseModel(mongoClientPrimary, mongoClientSecondary)
-	services := services.NewBaseService(models)
+	utils.SetRevocationChecker(models.Tokens)
+	utils.SetSubjectResolver(models.Auth)
+	notifier, err := services.NewNotifier(cfg.Notifier, cfg.NotifierFile, cfg.NotifierLogBodies)
+	if err != nil {
+		fmt.Printf("Failed to set up notifier: %v\n", err)
+		return
+	}
+	services := services.NewBaseService(models, notifier)
 	controllers.NewBaseController(services, models)
 
 	// Initialize coupon package
-	fmt.Println("Loading coupons into memory...")
+	fmt.Println("Loading coupons...")
 	if err := services.Coupons.Init(ctx); err != nil {
 		fmt.Printf("Failed to load coupons: %v\n", err)
 		return
@@ -73,9 +105,14 @@ func CreateServer(ctx context.Context) {
 		})
 	})
 
+	allowHeaders := []string{"Origin", "Content-Type", "Accept", "Authorization", "Idempotency-Key"}
+	if header := config.GetConfig().LegacyAPIKeyHeader; header != "" {
+		allowHeaders = append(allowHeaders, header)
+	}
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept",
+		AllowOrigins:  "*",
+		AllowHeaders:  strings.Join(allowHeaders, ", "),
+		ExposeHeaders: "WWW-Authenticate",
 	}))
 
 	routes.SetupRoutes(app)
@@ -91,7 +128,7 @@ func CreateServer(ctx context.Context) {
 	<-ctx.Done()
 	fmt.Println("server stopped")
 	if err := app.Shutdown(); err != nil {
-		fmt.Println("server Shutdown Failed:%+v", err)
+		fmt.Printf("server Shutdown Failed:%+v\n", err)
 	}
 	fmt.Println("server exited properly")
 }
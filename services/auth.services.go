@@ -3,20 +3,38 @@ package services
 import (
 	"errors"
 	"fmt"
+	"foodie-service/config"
 	"foodie-service/models"
 	"foodie-service/types"
 	"foodie-service/utils"
+	"net/url"
 	"regexp"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrInvalidCredentials  = errors.New("invalid email or password")
+	ErrInvalidRole         = errors.New("role must be one of customer, staff, admin")
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	ErrWeakPassword        = errors.New("password must be 8-24 characters with upper and lower case letters, a number and a special character")
+	ErrInvalidResetToken   = errors.New("password reset token is invalid or expired")
+	ErrInvalidVerifyToken  = errors.New("verification token is invalid or expired")
+	ErrAlreadyVerified     = errors.New("email is already verified")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; all sessions from this login have been revoked")
+)
+
 type AuthService struct {
-	models *models.BaseModel
+	models   *models.BaseModel
+	notifier Notifier
 }
 
-func NewAuthService(models *models.BaseModel) *AuthService {
-	return &AuthService{models: models}
+func NewAuthService(models *models.BaseModel, notifier Notifier) *AuthService {
+	return &AuthService{models: models, notifier: notifier}
 }
 
 func PasswordStrengthCheck(password string) bool {
@@ -35,26 +53,391 @@ func PasswordStrengthCheck(password string) bool {
 	return false
 }
 
-func (as *AuthService) SignIn(email string, password string) (*types.SignInResponse, error) {
+// isBootstrapAdmin reports whether email is listed in ADMIN_EMAILS, which is
+// how the first administrators are created
+func isBootstrapAdmin(email string) bool {
+	for _, admin := range config.GetConfig().AdminEmails {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// promoteBootstrapAdmin gives the admin role to a user listed in ADMIN_EMAILS.
+// It must only be called once the user has proved they own the email address,
+// otherwise whoever signs up with a listed address first would become admin.
+func promoteBootstrapAdmin(models *models.BaseModel, user *models.UserSchema) (*models.UserSchema, error) {
+	if user.Role == types.RoleAdmin || !isBootstrapAdmin(user.Email) {
+		return user, nil
+	}
+	return models.Auth.UpdateUserRole(user.UserID, types.RoleAdmin)
+}
+
+// LoginThrottledError is returned when an email or IP has failed to log in too
+// often and must wait before trying again
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed logins, account locked for %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed logins, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Audit reasons for rejected logins
+const (
+	loginFailedUnknownEmail  = "unknown_email"
+	loginFailedWrongPassword = "wrong_password"
+	loginFailedThrottled     = "throttled"
+)
+
+func emailLoginKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginDelay is how long a key must wait before its next login attempt. Emails
+// back off exponentially after each failure; both emails and IPs are locked
+// once they reach their failure limit.
+func loginDelay(attempt *models.LoginAttemptSchema, backoff bool, now time.Time) *LoginThrottledError {
+	if attempt == nil || !attempt.ExpiresAt.After(now) {
+		return nil
+	}
+	if attempt.LockedUntil != nil && attempt.LockedUntil.After(now) {
+		return &LoginThrottledError{RetryAfter: attempt.LockedUntil.Sub(now), Locked: true}
+	}
+	if !backoff || attempt.Failures == 0 {
+		return nil
+	}
+
+	cfg := config.GetConfig()
+	delay := cfg.LoginBackoffBase
+	for i := 1; i < attempt.Failures && delay < cfg.LoginLockoutDuration; i++ {
+		delay *= 2
+	}
+	if delay > cfg.LoginLockoutDuration {
+		delay = cfg.LoginLockoutDuration
+	}
+	if until := attempt.LastFailureAt.Add(delay); until.After(now) {
+		return &LoginThrottledError{RetryAfter: until.Sub(now)}
+	}
+	return nil
+}
+
+// checkLoginAllowed returns a LoginThrottledError when either the email or the
+// IP is still backing off or locked. It turns away retries that come too soon
+// without counting them; reserveLoginAttempt makes the binding decision.
+func (as *AuthService) checkLoginAllowed(email, ip string) error {
+	now := time.Now()
+	emailAttempt, err := as.models.Logins.GetLoginAttempt(emailLoginKey(email))
+	if err != nil {
+		return err
+	}
+	if throttled := loginDelay(emailAttempt, true, now); throttled != nil {
+		return throttled
+	}
+
+	ipAttempt, err := as.models.Logins.GetLoginAttempt(ipLoginKey(ip))
+	if err != nil {
+		return err
+	}
+	if throttled := loginDelay(ipAttempt, false, now); throttled != nil {
+		return throttled
+	}
+	return nil
+}
+
+// loginReservation is a login counted as a failure against an email and an
+// IP before the password is checked
+type loginReservation struct {
+	emailKey, ipKey           string
+	emailFailures, ipFailures int
+}
+
+// reserveLoginAttempt counts a login against the email and IP before the
+// password is checked. Concurrent logins each get their own count, so they
+// cannot all pass a check made before any of them failed. It returns a
+// LoginThrottledError when either was already backing off or locked, or this
+// attempt goes over its limit.
+func (as *AuthService) reserveLoginAttempt(email, ip string) (*loginReservation, error) {
+	cfg := config.GetConfig()
+	reservation := &loginReservation{emailKey: emailLoginKey(email), ipKey: ipLoginKey(ip)}
+
+	previous, failures, err := as.models.Logins.ReserveLoginAttempt(reservation.emailKey, cfg.LoginFailureWindow)
+	if err != nil {
+		return nil, err
+	}
+	if throttled := loginDelay(previous, true, time.Now()); throttled != nil {
+		return nil, throttled
+	}
+	if cfg.LoginMaxFailures > 0 && failures > cfg.LoginMaxFailures {
+		return nil, &LoginThrottledError{RetryAfter: cfg.LoginLockoutDuration, Locked: true}
+	}
+	reservation.emailFailures = failures
+
+	previous, failures, err = as.models.Logins.ReserveLoginAttempt(reservation.ipKey, cfg.LoginFailureWindow)
+	if err != nil {
+		return nil, err
+	}
+	if throttled := loginDelay(previous, false, time.Now()); throttled != nil {
+		return nil, throttled
+	}
+	if cfg.LoginMaxFailuresPerIP > 0 && failures > cfg.LoginMaxFailuresPerIP {
+		return nil, &LoginThrottledError{RetryAfter: cfg.LoginLockoutDuration, Locked: true}
+	}
+	reservation.ipFailures = failures
+	return reservation, nil
+}
+
+// recordLoginFailure locks whichever of the email and IP reached its limit
+// with this failed login, and writes the audit record
+func (as *AuthService) recordLoginFailure(reservation *loginReservation, email, ip, userAgent, reason string) {
+	cfg := config.GetConfig()
+	limits := []struct {
+		key      string
+		failures int
+		limit    int
+	}{
+		{reservation.emailKey, reservation.emailFailures, cfg.LoginMaxFailures},
+		{reservation.ipKey, reservation.ipFailures, cfg.LoginMaxFailuresPerIP},
+	}
+	for _, l := range limits {
+		if l.limit > 0 && l.failures >= l.limit {
+			if err := as.models.Logins.LockLogin(l.key, time.Now().Add(cfg.LoginLockoutDuration)); err != nil {
+				fmt.Println("failed to lock login:", err)
+			}
+		}
+	}
+	as.auditLoginFailure(email, ip, userAgent, reason)
+}
+
+// releaseLoginAttempt takes back a reserved login that did not fail
+func (as *AuthService) releaseLoginAttempt(reservation *loginReservation) {
+	for _, key := range []string{reservation.emailKey, reservation.ipKey} {
+		if err := as.models.Logins.ReleaseLoginAttempt(key); err != nil {
+			fmt.Println("failed to release login attempt:", err)
+		}
+	}
+}
+
+func (as *AuthService) auditLoginFailure(email, ip, userAgent, reason string) {
+	err := as.models.Logins.InsertLoginAudit(&models.LoginAuditSchema{
+		Email:     email,
+		IP:        ip,
+		UserAgent: userAgent,
+		Reason:    reason,
+	})
+	if err != nil {
+		fmt.Println("failed to write login audit:", err)
+	}
+}
+
+// dummyPasswordHash is compared against when no user has the email, so that
+// an unknown email takes as long to reject as a wrong password. It has the
+// cost of the hashes SignUp stores.
+var dummyPasswordHash = []byte("$2a$10$UcPrTvBVIah2xvWcGt.6keg9c5/Ek3AXdZUJ3.fxmle.1S4zz.Tbe")
+
+// SignIn checks a user's password and issues tokens. Repeated failures for an
+// email or from an IP are throttled, see reserveLoginAttempt.
+func (as *AuthService) SignIn(email, password, ip, userAgent string) (*types.SignInResponse, error) {
+	err := as.checkLoginAllowed(email, ip)
+	var reservation *loginReservation
+	if err == nil {
+		reservation, err = as.reserveLoginAttempt(email, ip)
+	}
+	if err != nil {
+		var throttled *LoginThrottledError
+		if errors.As(err, &throttled) {
+			as.auditLoginFailure(email, ip, userAgent, loginFailedThrottled)
+		}
+		return nil, err
+	}
+
 	user, err := as.models.Auth.GetUserByEmail(email)
-	if err != nil || user == nil {
-		fmt.Println(err)
-		return nil, errors.New("user not found")
+	if err != nil && err != mongo.ErrNoDocuments {
+		as.releaseLoginAttempt(reservation)
+		return nil, err
+	}
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		as.recordLoginFailure(reservation, email, ip, userAgent, loginFailedUnknownEmail)
+		return nil, ErrInvalidCredentials
 	}
 
 	// use bcrypt to compare password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
-		fmt.Println(err)
+		as.recordLoginFailure(reservation, email, ip, userAgent, loginFailedWrongPassword)
+		return nil, ErrInvalidCredentials
+	}
+
+	as.releaseLoginAttempt(reservation)
+	if err := as.models.Logins.ClearLoginAttempts(reservation.emailKey); err != nil {
+		fmt.Println("failed to clear login attempts:", err)
+	}
+	return as.issueTokens(user, uuid.New().String())
+}
+
+// tokenSubject is the identifier put in a user's tokens and used to find the
+// user again when a token is presented. The uuid never changes, unlike the
+// email address.
+func tokenSubject(user *models.UserSchema) string {
+	return user.UserID
+}
+
+// userForSubject finds the user a token was issued to. Tokens issued before
+// subjects were uuids carry the email address instead.
+func userForSubject(models *models.BaseModel, subject string) (*models.UserSchema, error) {
+	if strings.Contains(subject, "@") {
+		return models.Auth.GetUserByEmail(subject)
+	}
+	return models.Auth.GetUserByUserID(subject)
+}
+
+// issueTokens creates an access token and a refresh token belonging to
+// familyID. Only the hash of the refresh token is stored.
+func (as *AuthService) issueTokens(user *models.UserSchema, familyID string) (*types.SignInResponse, error) {
+	subject := tokenSubject(user)
+	token, err := utils.GenerateToken(subject, user.EffectiveRole())
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, refreshHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	err = as.models.Tokens.InsertRefreshToken(&models.RefreshTokenSchema{
+		TokenHash: refreshHash,
+		UserID:    subject,
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(config.GetConfig().RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.SignInResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(config.GetConfig().AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token pair.
+// Each refresh token works once; presenting one that was already exchanged
+// revokes every token descended from the same login.
+func (as *AuthService) Refresh(refreshToken string) (*types.SignInResponse, error) {
+	tokenHash := utils.HashToken(refreshToken)
+	stored, err := as.models.Tokens.GetRefreshToken(tokenHash)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidRefreshToken
+		}
 		return nil, err
 	}
-	fmt.Println(user)
-	token, err := utils.GenerateToken(user.Email)
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Reserve the replacement before issuing it so that two concurrent
+	// refreshes with the same token cannot both succeed
+	nextToken, nextHash, err := utils.GenerateOpaqueToken()
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
-	return &types.SignInResponse{Token: token}, nil
+	fresh := stored.RevokedAt == nil
+	if fresh {
+		fresh, err = as.models.Tokens.MarkRefreshTokenUsed(tokenHash, nextHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !fresh {
+		if err := as.models.Tokens.RevokeRefreshTokenFamily(stored.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	user, err := userForSubject(as.models, stored.UserID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	token, err := utils.GenerateToken(tokenSubject(user), user.EffectiveRole())
+	if err != nil {
+		return nil, err
+	}
+	err = as.models.Tokens.InsertRefreshToken(&models.RefreshTokenSchema{
+		TokenHash: nextHash,
+		UserID:    tokenSubject(user),
+		FamilyID:  stored.FamilyID,
+		ExpiresAt: time.Now().Add(config.GetConfig().RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.SignInResponse{
+		Token:        token,
+		RefreshToken: nextToken,
+		ExpiresIn:    int64(config.GetConfig().AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Logout denylists the access token used for the request and, when given,
+// revokes the refresh token issued alongside it. The refresh token must belong
+// to subject, the user the access token was issued to, so a leaked refresh
+// token cannot be used to end someone else's sessions.
+func (as *AuthService) Logout(subject string, tokenID string, tokenExpiresAt time.Time, refreshToken string) error {
+	var stored *models.RefreshTokenSchema
+	if refreshToken != "" {
+		var err error
+		stored, err = as.models.Tokens.GetRefreshToken(utils.HashToken(refreshToken))
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if !as.sameUser(stored.UserID, subject) {
+			return ErrInvalidRefreshToken
+		}
+	}
+
+	if tokenID != "" {
+		if err := as.models.Tokens.RevokeAccessToken(tokenID, tokenExpiresAt); err != nil {
+			return err
+		}
+	}
+	if stored == nil {
+		return nil
+	}
+	return as.models.Tokens.RevokeRefreshTokenFamily(stored.FamilyID)
+}
+
+// sameUser reports whether two token subjects name the same user. Tokens
+// issued before subjects were uuids carry the email address instead.
+func (as *AuthService) sameUser(subject, other string) bool {
+	if subject == other {
+		return true
+	}
+	user, err := userForSubject(as.models, subject)
+	if err != nil {
+		return false
+	}
+	otherUser, err := userForSubject(as.models, other)
+	if err != nil {
+		return false
+	}
+	return user.UserID == otherUser.UserID
 }
 
 func (as *AuthService) SignUp(userDetails *types.SignupRequest) (*types.SignupResponse, error) {
@@ -64,7 +447,7 @@ func (as *AuthService) SignUp(userDetails *types.SignupRequest) (*types.SignupRe
 	}
 
 	isPasswordStrong := PasswordStrengthCheck(userDetails.Password)
-    if(!isPasswordStrong){
+	if !isPasswordStrong {
 		return nil, errors.New("passowrd is weak")
 	}
 
@@ -78,6 +461,7 @@ func (as *AuthService) SignUp(userDetails *types.SignupRequest) (*types.SignupRe
 	user := &models.UserSchema{
 		Email:    userDetails.Email,
 		Password: string(hashedPassword),
+		Role:     types.RoleCustomer,
 	}
 
 	user, err = as.models.Auth.CreateUser(user)
@@ -85,5 +469,159 @@ func (as *AuthService) SignUp(userDetails *types.SignupRequest) (*types.SignupRe
 		return nil, err
 	}
 
+	// The account exists even if the email cannot be sent; the user can ask
+	// for another one
+	if err := as.sendVerificationEmail(user); err != nil {
+		fmt.Println("failed to send verification email:", err)
+	}
+
 	return &types.SignupResponse{UserID: user.UserID}, nil
 }
+
+func (as *AuthService) sendVerificationEmail(user *models.UserSchema) error {
+	token, tokenHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	ttl := config.GetConfig().EmailVerificationTTL
+	err = as.models.Tokens.InsertOneTimeToken(models.EmailVerificationToken, &models.OneTimeTokenSchema{
+		TokenHash: tokenHash,
+		UserID:    user.UserID,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := strings.TrimSuffix(config.GetConfig().PublicBaseURL, "/") + "/auth/verify?token=" + url.QueryEscape(token)
+	return as.notifier.Notify(Notification{
+		To:      user.Email,
+		Subject: "Verify your Foodie email",
+		Body:    fmt.Sprintf("Confirm your email address by opening this link within %s:\n\n%s", ttl, link),
+		SentAt:  time.Now(),
+	})
+}
+
+// ResendVerificationEmail sends a fresh verification link to the signed in
+// user, invalidating earlier ones
+func (as *AuthService) ResendVerificationEmail(subject string) error {
+	user, err := userForSubject(as.models, subject)
+	if err != nil {
+		return err
+	}
+	if user.Verified {
+		return ErrAlreadyVerified
+	}
+	return as.sendVerificationEmail(user)
+}
+
+// VerifyEmail marks the user a verification token was sent to as verified.
+// Users listed in ADMIN_EMAILS become admins at this point.
+func (as *AuthService) VerifyEmail(token string) error {
+	verification, err := as.models.Tokens.ConsumeOneTimeToken(models.EmailVerificationToken, utils.HashToken(token))
+	if err == mongo.ErrNoDocuments {
+		return ErrInvalidVerifyToken
+	}
+	if err != nil {
+		return err
+	}
+
+	err = as.models.Auth.MarkUserVerified(verification.UserID)
+	if err == mongo.ErrNoDocuments {
+		return ErrInvalidVerifyToken
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := as.models.Auth.GetUserByUserID(verification.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = promoteBootstrapAdmin(as.models, user)
+	return err
+}
+
+// ForgotPassword emails a single-use reset token to the user. Unknown emails
+// are ignored so callers cannot tell which addresses have accounts.
+func (as *AuthService) ForgotPassword(email string) error {
+	user, err := as.models.Auth.GetUserByEmail(email)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, tokenHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	ttl := config.GetConfig().PasswordResetTTL
+	err = as.models.Tokens.InsertOneTimeToken(models.PasswordResetToken, &models.OneTimeTokenSchema{
+		TokenHash: tokenHash,
+		UserID:    user.UserID,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	// A delivery failure is logged rather than returned, since failing only for
+	// existing accounts would reveal which emails are registered
+	err = as.notifier.Notify(Notification{
+		To:      user.Email,
+		Subject: "Reset your Foodie password",
+		Body: fmt.Sprintf("Use this token to reset your password. It expires in %s and can only be used once.\n\n%s",
+			ttl, token),
+		SentAt: time.Now(),
+	})
+	if err != nil {
+		fmt.Println("failed to send password reset:", err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword and
+// signs the user out everywhere
+func (as *AuthService) ResetPassword(token string, password string) error {
+	// Check the password first so a weak one does not use up the token
+	if !PasswordStrengthCheck(password) {
+		return ErrWeakPassword
+	}
+
+	reset, err := as.models.Tokens.ConsumeOneTimeToken(models.PasswordResetToken, utils.HashToken(token))
+	if err == mongo.ErrNoDocuments {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user, err := as.models.Auth.UpdateUserPassword(reset.UserID, string(hashedPassword))
+	if err == mongo.ErrNoDocuments {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := as.models.Tokens.RevokeUserRefreshTokens(tokenSubject(user)); err != nil {
+		return err
+	}
+	if err := as.models.Logins.ClearLoginAttempts(emailLoginKey(user.Email)); err != nil {
+		fmt.Println("failed to clear login attempts:", err)
+	}
+	return nil
+}
+
+func (as *AuthService) UpdateUserRole(userID string, role types.Role) (*models.UserSchema, error) {
+	if !role.IsValid() {
+		return nil, ErrInvalidRole
+	}
+	return as.models.Auth.UpdateUserRole(userID, role)
+}
@@ -9,20 +9,30 @@ type BaseService struct {
 	Orders   *OrdersService
 	Auth     *AuthService
 	Coupons  *CouponService
+	Cart     *CartService
+	Users    *UsersService
+	OIDC     *OIDCService
 }
 
 var baseService *BaseService
 
-func NewBaseService(models *models.BaseModel) *BaseService {
+func NewBaseService(models *models.BaseModel, notifier Notifier) *BaseService {
 	if baseService != nil {
 		return baseService
 	}
 
+	coupons := NewCouponService(models)
+	orders := NewOrdersService(models, coupons)
+	auth := NewAuthService(models, notifier)
+
 	baseService = &BaseService{
 		Products: NewProductsService(models),
-		Orders:   NewOrdersService(models),
-		Auth:     NewAuthService(models),
-		Coupons:  NewCouponService(models),
+		Orders:   orders,
+		Auth:     auth,
+		Coupons:  coupons,
+		Cart:     NewCartService(models, orders, coupons),
+		Users:    NewUsersService(models),
+		OIDC:     NewOIDCService(models, auth),
 	}
 	return baseService
 }
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"foodie-service/models"
+	"foodie-service/types"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var (
+	ErrCartEmpty     = errors.New("cart is empty")
+	ErrCartChanged   = errors.New("cart changed during checkout")
+	ErrInvalidCoupon = errors.New("invalid coupon code")
+)
+
+type CartService struct {
+	models  *models.BaseModel
+	orders  *OrdersService
+	coupons *CouponService
+}
+
+func NewCartService(models *models.BaseModel, orders *OrdersService, coupons *CouponService) *CartService {
+	return &CartService{
+		models:  models,
+		orders:  orders,
+		coupons: coupons,
+	}
+}
+
+// GetCart returns the user's cart priced against the current catalogue
+func (cs *CartService) GetCart(userID string) (*types.CartDetails, error) {
+	cart, err := cs.models.Cart.GetCart(userID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return &types.CartDetails{Items: []types.CartItem{}}, nil
+		}
+		return nil, err
+	}
+
+	details := &types.CartDetails{
+		Items:      []types.CartItem{},
+		CouponCode: cart.CouponCode,
+		UpdatedAt:  cart.UpdatedAt,
+	}
+	ids := make([]string, len(cart.Items))
+	for i, item := range cart.Items {
+		ids[i] = item.ProductID
+	}
+	productsByID, err := cs.models.Products.GetProductsByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	lineItems := []types.LineItem{}
+	for _, item := range cart.Items {
+		cartItem := types.CartItem{ProductID: item.ProductID, Quantity: item.Quantity}
+		if product, ok := productsByID[item.ProductID]; ok && !product.Archived {
+			cartItem.Product = &product
+			cartItem.Available = true
+			cartItem.LineTotal = product.Price * float64(item.Quantity)
+			details.TotalPrice += cartItem.LineTotal
+			lineItems = append(lineItems, newLineItem(product, item.Quantity))
+		}
+		details.Items = append(details.Items, cartItem)
+	}
+
+	if cart.CouponCode != "" {
+		discount, err := cs.coupons.Evaluate(cart.CouponCode, userID, lineItems)
+		var rejected *CouponRejectedError
+		switch {
+		case errors.As(err, &rejected):
+			details.CouponError = rejected.Error()
+			details.CouponRejection = rejected.Reason
+		case err != nil:
+			return nil, err
+		default:
+			details.Discount = discount
+		}
+	}
+	details.FinalPrice = details.TotalPrice - details.Discount
+
+	return details, nil
+}
+
+func (cs *CartService) AddItem(userID string, item *types.CartItemRequest) (*types.CartDetails, error) {
+	product, err := cs.models.Products.GetProductByProductId(item.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	if product.Archived {
+		return nil, mongo.ErrNoDocuments
+	}
+	if err := cs.models.Cart.AddItem(userID, item.ProductID, item.Quantity); err != nil {
+		return nil, err
+	}
+	return cs.GetCart(userID)
+}
+
+func (cs *CartService) UpdateItem(userID string, item *types.CartItemRequest) (*types.CartDetails, error) {
+	if err := cs.models.Cart.SetItemQuantity(userID, item.ProductID, item.Quantity); err != nil {
+		return nil, err
+	}
+	return cs.GetCart(userID)
+}
+
+func (cs *CartService) RemoveItem(userID string, productID string) (*types.CartDetails, error) {
+	if err := cs.models.Cart.RemoveItem(userID, productID); err != nil {
+		return nil, err
+	}
+	return cs.GetCart(userID)
+}
+
+func (cs *CartService) ApplyCoupon(userID string, couponCode string) (*types.CartDetails, error) {
+	// Rules that depend on what is in the cart are checked, and reported on
+	// the cart, whenever it is priced
+	_, err := cs.coupons.Evaluate(couponCode, userID, nil)
+	var rejected *CouponRejectedError
+	if errors.As(err, &rejected) && rejected.DependsOnOrder() {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.models.Cart.SetCoupon(userID, couponCode); err != nil {
+		return nil, err
+	}
+	return cs.GetCart(userID)
+}
+
+func (cs *CartService) RemoveCoupon(userID string) (*types.CartDetails, error) {
+	if err := cs.models.Cart.SetCoupon(userID, ""); err != nil {
+		return nil, err
+	}
+	return cs.GetCart(userID)
+}
+
+func (cs *CartService) ClearCart(userID string) error {
+	return cs.models.Cart.ClearCart(userID)
+}
+
+// Checkout places an order for everything in the cart and empties it. An empty
+// addressID delivers to the user's default address.
+func (cs *CartService) Checkout(userID string, addressID string) (*types.PurchaseDetails, error) {
+	return cs.checkout(userID, addressID, nil)
+}
+
+// CheckoutWithIdempotencyKey checks out at most once per key, as
+// PlaceOrderWithIdempotencyKey does for orders
+func (cs *CartService) CheckoutWithIdempotencyKey(userID string, addressID string, key string, requestHash string) (*types.PurchaseDetails, error) {
+	return cs.orders.placeOnce(key, userID, requestHash, func(store afterInsertFunc) (*types.PurchaseDetails, error) {
+		return cs.checkout(userID, addressID, store)
+	})
+}
+
+func (cs *CartService) checkout(userID string, addressID string, afterInsert afterInsertFunc) (*types.PurchaseDetails, error) {
+	cart, err := cs.models.Cart.GetCart(userID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if cart == nil || len(cart.Items) == 0 {
+		return nil, ErrCartEmpty
+	}
+
+	orderRequest := &types.BulkOrdersRequest{CouponCode: cart.CouponCode, AddressID: addressID}
+	for _, item := range cart.Items {
+		orderRequest.Items = append(orderRequest.Items, types.Order{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	// The cart is emptied in the order's transaction, and only if it still
+	// holds what was ordered, so a checkout never leaves the cart behind and
+	// never drops items added while it ran
+	return cs.orders.placeOrder(orderRequest, userID, func(ctx context.Context, purchaseDetails *types.PurchaseDetails) error {
+		deleted, err := cs.models.Cart.DeleteCheckedOutCart(ctx, cart)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return ErrCartChanged
+		}
+		if afterInsert != nil {
+			return afterInsert(ctx, purchaseDetails)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,388 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"foodie-service/config"
+	"foodie-service/models"
+)
+
+// The gzip import keeps the codes that appear in at least two of the files.
+// The files hold far more codes than fit in memory, so the import runs in
+// two phases that each read their input once:
+//
+//  1. Partition: every file is streamed once and each code is appended to one
+//     of the bucket files in the import directory, chosen by a hash of the
+//     code. The same code always lands in the same bucket, whichever file it
+//     comes from.
+//  2. Merge: the buckets are read one at a time. A bucket only holds a small
+//     share of the codes, so the codes of every file in it can be compared in
+//     memory, and those found in two or more files are upserted.
+//
+// Progress is checkpointed in the state file after each file is partitioned
+// and after each bucket is merged. An interrupted import starts again from the
+// file or bucket it was working on, and upserting leaves codes written before
+// the interruption as they are.
+
+const (
+	couponImportStateFile = "state.json"
+	// minCouponCodeLength and maxCouponCodeLength bound the words of the
+	// files that are taken as codes
+	minCouponCodeLength = 8
+	maxCouponCodeLength = 10
+	// maxCouponImportFiles is how many files fit in the bitmask recording
+	// which files a code was found in
+	maxCouponImportFiles = 64
+)
+
+// couponImportState is the checkpoint of an import. An import only resumes
+// from a checkpoint made for the same files and number of buckets.
+type couponImportState struct {
+	Files   []string `json:"files"`
+	Buckets int      `json:"buckets"`
+	// Partitioned is how many files have been split into buckets
+	Partitioned int `json:"partitioned"`
+	// Merged is how many buckets have been written to the database
+	Merged int  `json:"merged"`
+	Done   bool `json:"done"`
+}
+
+func (s *couponImportState) matches(files []string, buckets int) bool {
+	return s.Buckets == buckets && slices.Equal(s.Files, files)
+}
+
+// couponImport runs the import of the configured files using dir for its
+// buckets and checkpoint
+type couponImport struct {
+	models  *models.BaseModel
+	files   []string
+	dir     string
+	buckets int
+	state   *couponImportState
+}
+
+func newCouponImport(models *models.BaseModel) (*couponImport, error) {
+	cfg := config.GetConfig()
+	if len(cfg.CouponFiles) > maxCouponImportFiles {
+		return nil, fmt.Errorf("at most %d coupon files can be imported, got %d", maxCouponImportFiles, len(cfg.CouponFiles))
+	}
+	if cfg.CouponImportBuckets < 1 {
+		return nil, fmt.Errorf("COUPON_IMPORT_BUCKETS must be at least 1")
+	}
+
+	imp := &couponImport{
+		models:  models,
+		files:   cfg.CouponFiles,
+		dir:     cfg.CouponImportDir,
+		buckets: cfg.CouponImportBuckets,
+	}
+	state, err := imp.readState()
+	if err != nil {
+		return nil, err
+	}
+	imp.state = state
+	return imp, nil
+}
+
+// Interrupted reports whether an earlier import of the same files stopped
+// before it finished
+func (imp *couponImport) Interrupted() bool {
+	return imp.state != nil && !imp.state.Done && imp.state.matches(imp.files, imp.buckets)
+}
+
+// Run imports the files, resuming an interrupted import
+func (imp *couponImport) Run(ctx context.Context) error {
+	if !imp.Interrupted() {
+		if imp.state != nil && !imp.state.Done {
+			fmt.Println("Coupon files or bucket count changed since the last import. Starting over.")
+		}
+		if err := imp.clear(); err != nil {
+			return err
+		}
+		imp.state = &couponImportState{Files: imp.files, Buckets: imp.buckets}
+		// Written before any bucket exists, so the directory is recognised
+		// as the import's own if this run is interrupted
+		if err := imp.writeState(); err != nil {
+			return err
+		}
+	}
+
+	for imp.state.Partitioned < len(imp.files) {
+		index := imp.state.Partitioned
+		if err := imp.partition(ctx, index); err != nil {
+			return fmt.Errorf("error processing file %s: %v", imp.files[index], err)
+		}
+		imp.state.Partitioned++
+		if err := imp.writeState(); err != nil {
+			return err
+		}
+	}
+
+	for imp.state.Merged < imp.buckets {
+		if err := imp.merge(ctx, imp.state.Merged); err != nil {
+			return fmt.Errorf("error merging bucket %d: %v", imp.state.Merged, err)
+		}
+		imp.state.Merged++
+		if err := imp.writeState(); err != nil {
+			return err
+		}
+	}
+
+	// The buckets are no longer needed; the state file stays to record that
+	// the import finished
+	for index := range imp.files {
+		if err := os.RemoveAll(imp.fileDir(index)); err != nil {
+			return fmt.Errorf("failed to remove buckets: %v", err)
+		}
+	}
+	imp.state.Done = true
+	return imp.writeState()
+}
+
+// clear removes what an earlier import left in the import directory,
+// creating it if needed. Only the state file and bucket directories are
+// removed, and a directory with other files but no state file is refused, so
+// pointing COUPON_IMPORT_DIR somewhere shared never deletes anything else.
+func (imp *couponImport) clear() error {
+	if err := os.MkdirAll(imp.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create import directory: %v", err)
+	}
+	entries, err := os.ReadDir(imp.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read import directory: %v", err)
+	}
+
+	statePath := filepath.Join(imp.dir, couponImportStateFile)
+	if _, err := os.Stat(statePath); errors.Is(err, os.ErrNotExist) && len(entries) > 0 {
+		return fmt.Errorf("import directory %s is not empty and was not created by an import; set COUPON_IMPORT_DIR to an empty or new directory", imp.dir)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !isBucketDir(entry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(imp.dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove buckets: %v", err)
+		}
+	}
+	for _, path := range []string{statePath, statePath + ".tmp"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove import state: %v", err)
+		}
+	}
+	return nil
+}
+
+// isBucketDir reports whether name is a directory made by fileDir
+func isBucketDir(name string) bool {
+	index, ok := strings.CutPrefix(name, "file-")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(index)
+	return err == nil
+}
+
+func (imp *couponImport) fileDir(index int) string {
+	return filepath.Join(imp.dir, fmt.Sprintf("file-%d", index))
+}
+
+func (imp *couponImport) bucketPath(index, bucket int) string {
+	return filepath.Join(imp.fileDir(index), fmt.Sprintf("bucket-%04d", bucket))
+}
+
+func (imp *couponImport) bucketOf(code string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(code))
+	return int(hash.Sum32() % uint32(imp.buckets))
+}
+
+// partition streams one file into its buckets. Buckets left behind by an
+// interrupted run of the same file are discarded first.
+func (imp *couponImport) partition(ctx context.Context, index int) error {
+	filename := imp.files[index]
+	fmt.Printf("Partitioning file %s into %d buckets...\n", filename, imp.buckets)
+
+	dir := imp.fileDir(index)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("error creating gzip reader: %v", err)
+	}
+	defer gzReader.Close()
+
+	bucketFiles := make([]*os.File, imp.buckets)
+	writers := make([]*bufio.Writer, imp.buckets)
+	defer func() {
+		for _, bucketFile := range bucketFiles {
+			if bucketFile != nil {
+				bucketFile.Close()
+			}
+		}
+	}()
+	for bucket := range bucketFiles {
+		if bucketFiles[bucket], err = os.Create(imp.bucketPath(index, bucket)); err != nil {
+			return err
+		}
+		writers[bucket] = bufio.NewWriterSize(bucketFiles[bucket], 64*1024)
+	}
+
+	scanner := bufio.NewScanner(gzReader)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	scanner.Split(bufio.ScanWords)
+
+	count := 0
+	for scanner.Scan() {
+		code := strings.TrimSpace(scanner.Text())
+		if len(code) < minCouponCodeLength || len(code) > maxCouponCodeLength {
+			continue
+		}
+		writer := writers[imp.bucketOf(code)]
+		writer.WriteString(code)
+		if err := writer.WriteByte('\n'); err != nil {
+			return err
+		}
+
+		count++
+		if count%1_000_000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if count%10_000_000 == 0 {
+				fmt.Printf("Partitioned %d codes from %s...\n", count, filename)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error scanning file %s: %v", filename, err)
+	}
+
+	// The file only counts as partitioned once every bucket is on disk
+	for bucket, writer := range writers {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if err := bucketFiles[bucket].Sync(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Partitioned %d codes from %s\n", count, filename)
+	return nil
+}
+
+// merge upserts the codes of one bucket that appear in two or more files
+func (imp *couponImport) merge(ctx context.Context, bucket int) error {
+	// Each code maps to a bitmask of the files it was found in
+	found := make(map[string]uint64)
+	for index := range imp.files {
+		if err := imp.readBucket(ctx, index, bucket, found); err != nil {
+			return err
+		}
+	}
+
+	var coupons []models.Coupon
+	for code, mask := range found {
+		if bits.OnesCount64(mask) < 2 {
+			continue
+		}
+		var fileList []string
+		for index, filename := range imp.files {
+			if mask&(1<<index) != 0 {
+				fileList = append(fileList, filename)
+			}
+		}
+		coupons = append(coupons, models.Coupon{
+			Code:        code,
+			FileList:    fileList,
+			Appearances: len(fileList),
+		})
+	}
+
+	if err := imp.models.Coupons.UpsertImportedCoupons(ctx, coupons); err != nil {
+		return err
+	}
+	fmt.Printf("Merged bucket %d/%d: %d unique codes, %d in multiple files\n",
+		bucket+1, imp.buckets, len(found), len(coupons))
+	return nil
+}
+
+func (imp *couponImport) readBucket(ctx context.Context, index, bucket int, found map[string]uint64) error {
+	file, err := os.Open(imp.bucketPath(index, bucket))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	count := 0
+	for scanner.Scan() {
+		found[scanner.Text()] |= 1 << index
+
+		count++
+		if count%1_000_000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// readState returns the checkpoint of the last import, or nil if there is none
+func (imp *couponImport) readState() (*couponImportState, error) {
+	data, err := os.ReadFile(filepath.Join(imp.dir, couponImportStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import state: %v", err)
+	}
+
+	var state couponImportState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse import state: %v", err)
+	}
+	return &state, nil
+}
+
+// writeState replaces the checkpoint through a rename, so an interruption
+// leaves either the old or the new state behind
+func (imp *couponImport) writeState() error {
+	data, err := json.Marshal(imp.state)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(imp.dir, couponImportStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("failed to write import state: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write import state: %v", err)
+	}
+	return nil
+}
@@ -1,22 +1,27 @@
 package services
 
 import (
-	"bufio"
-	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"os"
+	"math"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
-	"foodie-service/models" 
+	"foodie-service/models"
+	"foodie-service/types"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
-type codeWithFile struct {
-	code string
-	file string
-}
+var (
+	ErrInvalidCouponRules = errors.New("invalid coupon")
+	ErrCouponExists       = errors.New("a coupon with this code already exists")
+)
 
 type CouponService struct {
 	models *models.BaseModel
@@ -34,13 +39,8 @@ func NewCouponService(models *models.BaseModel) *CouponService {
 }
 
 var (
-	filePaths = []string{"couponbase1.gz", "couponbase2.gz", "couponbase3.gz"}
-	once      sync.Once
-	loadErr   error
-)
-
-const (
-	batchSize = 20_000_000
+	once    sync.Once
+	loadErr error
 )
 
 // Init initializes the database connection and loads coupons if needed
@@ -57,220 +57,514 @@ func (cs *CouponService) Init(ctx context.Context) error {
 			return
 		}
 
-		if !exists {
-			err = cs.loadCouponsToDB(ctx)
-			if err != nil {
-				loadErr = fmt.Errorf("failed to load coupons: %v", err)
-				return
-			}
-		} else {
+		imp, err := newCouponImport(cs.models)
+		if err != nil {
+			loadErr = fmt.Errorf("failed to load coupons: %v", err)
+			return
+		}
+		// An interrupted import has already written some coupons, so it is
+		// resumed even though the collection is not empty
+		switch {
+		case imp.Interrupted():
+			fmt.Println("Resuming interrupted coupon import...")
+		case exists:
 			fmt.Println("Coupons collection already exists and has data. Skipping load.")
+			return
+		}
+
+		startTime := time.Now()
+		if err := imp.Run(ctx); err != nil {
+			loadErr = fmt.Errorf("failed to load coupons: %v", err)
+			return
 		}
+		fmt.Printf("Coupon import completed in %v\n", time.Since(startTime))
 	})
 
 	return loadErr
 }
 
-func (cs *CouponService) loadCouponsToDB(ctx context.Context) error {
-	fmt.Printf("Starting batch processing of coupons (batch size: %d records per file)...\n", batchSize)
-	startTime := time.Now()
-
-	totalProcessed := 0
-	batchNumber := 1
-
-	for {
-		fmt.Printf("\nProcessing Batch #%d (offset: %d records)...\n", batchNumber, totalProcessed)
-		batchStartTime := time.Now()
-
-		codeChan := make(chan codeWithFile, 200000)
-		readerErrors := make(chan error, len(filePaths))
-
-		// Start file readers for this batch
-		var wgReaders sync.WaitGroup
-		for _, file := range filePaths {
-			wgReaders.Add(1)
-			go func(filename string) {
-				defer wgReaders.Done()
-				fmt.Printf("Processing file: %s (batch offset: %d, limit: %d)\n",
-					filename, totalProcessed, batchSize)
-
-				if err := readFileToChannelWithOffset(ctx, filename, codeChan, totalProcessed, batchSize); err != nil {
-					readerErrors <- fmt.Errorf("error processing file %s: %v", filename, err)
-					return
-				}
-				fmt.Printf("Completed reading batch from file %s\n", filename)
-			}(file)
-		}
+// CouponRejectedError is returned when a coupon cannot be used on an order.
+// It matches ErrInvalidCoupon.
+type CouponRejectedError struct {
+	Code   string
+	Reason types.CouponRejectionReason
+	Detail string
+}
 
-		go func() {
-			wgReaders.Wait()
-			close(codeChan)
-			close(readerErrors)
-		}()
-
-		// Process this batch
-		codesWithFiles := make(map[string][]string)
-		batchReadCount := 0
-		readProgressTime := time.Now()
-
-		for cf := range codeChan {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
-			}
+func (e *CouponRejectedError) Error() string {
+	return fmt.Sprintf("coupon %s cannot be used: %s", e.Code, e.Detail)
+}
 
-			files := codesWithFiles[cf.code]
-			found := false
-			for _, f := range files {
-				if f == cf.file {
-					found = true
-					break
-				}
-			}
-			if !found {
-				codesWithFiles[cf.code] = append(files, cf.file)
-			}
+func (e *CouponRejectedError) Unwrap() error {
+	return ErrInvalidCoupon
+}
 
-			batchReadCount++
-			if batchReadCount%1000000 == 0 && time.Since(readProgressTime) > 5*time.Second {
-				fmt.Printf("Collected %d codes in current batch...\n", batchReadCount)
-				readProgressTime = time.Now()
-			}
+// DependsOnOrder reports whether the coupon could still apply to a different
+// order, for example once more items are added to a cart
+func (e *CouponRejectedError) DependsOnOrder() bool {
+	return e.Reason == types.CouponMinOrderNotMet || e.Reason == types.CouponNotApplicable
+}
+
+func rejectCoupon(code string, reason types.CouponRejectionReason, format string, args ...interface{}) error {
+	return &CouponRejectedError{Code: code, Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Evaluate works out the discount a coupon gives on an order of items placed
+// by userID. It returns a CouponRejectedError when the coupon does not apply.
+func (cs *CouponService) Evaluate(code string, userID string, items []types.LineItem) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coupon, err := cs.models.Coupons.GetCoupon(ctx, code)
+	if err == mongo.ErrNoDocuments {
+		return 0, rejectCoupon(code, types.CouponNotFound, "no coupon has this code")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkCouponValidity(coupon, time.Now()); err != nil {
+		return 0, err
+	}
+	if err := cs.checkRedemptionLimits(ctx, coupon, userID); err != nil {
+		return 0, err
+	}
+	return couponDiscount(coupon, items)
+}
+
+// checkCouponValidity rejects coupons that are switched off or outside their
+// validity window
+func checkCouponValidity(coupon *models.Coupon, now time.Time) error {
+	switch {
+	case !coupon.IsActive():
+		return rejectCoupon(coupon.Code, types.CouponInactive, "coupon is not active")
+	case coupon.StartsAt != nil && now.Before(*coupon.StartsAt):
+		return rejectCoupon(coupon.Code, types.CouponNotStarted, "coupon can be used from %s", coupon.StartsAt.Format(time.RFC3339))
+	case coupon.EndsAt != nil && !now.Before(*coupon.EndsAt):
+		return rejectCoupon(coupon.Code, types.CouponExpired, "coupon expired at %s", coupon.EndsAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkRedemptionLimits rejects coupons that have been used as often as they
+// allow, overall or by userID. Redeem repeats the check atomically when the
+// order is placed.
+func (cs *CouponService) checkRedemptionLimits(ctx context.Context, coupon *models.Coupon, userID string) error {
+	if coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions {
+		return rejectCoupon(coupon.Code, types.CouponUsageLimitReached, "coupon has been used the maximum number of times")
+	}
+	if coupon.MaxRedemptionsPerUser > 0 && userID != "" {
+		used, err := cs.models.Coupons.CountUserRedemptions(ctx, coupon.Code, userID)
+		if err != nil {
+			return err
+		}
+		if used >= int64(coupon.MaxRedemptionsPerUser) {
+			return rejectCoupon(coupon.Code, types.CouponUserLimitReached, "you have already used this coupon %d time(s)", used)
 		}
+	}
+	return nil
+}
 
-		// Check for reader errors
-		for err := range readerErrors {
-			if err != nil {
-				return err
-			}
+// Redeem records that orderID uses a coupon. It must run inside the
+// transaction that stores the order: the conditional increment keeps the
+// total under maxRedemptions, and because it writes the coupon document,
+// concurrent redemptions of the same coupon are serialised, which keeps the
+// per-user count accurate too.
+func (cs *CouponService) Redeem(ctx context.Context, code string, userID string, orderID string) error {
+	coupon, err := cs.models.Coupons.IncrementRedemptions(ctx, code)
+	if err != nil {
+		return err
+	}
+	if coupon == nil {
+		return rejectCoupon(code, types.CouponUsageLimitReached, "coupon has been used the maximum number of times")
+	}
+
+	if coupon.MaxRedemptionsPerUser > 0 {
+		used, err := cs.models.Coupons.CountUserRedemptions(ctx, code, userID)
+		if err != nil {
+			return err
+		}
+		if used >= int64(coupon.MaxRedemptionsPerUser) {
+			return rejectCoupon(code, types.CouponUserLimitReached, "you have already used this coupon %d time(s)", used)
 		}
+	}
+
+	return cs.models.Coupons.InsertRedemption(ctx, &models.CouponRedemptionSchema{
+		Code:    code,
+		UserID:  userID,
+		OrderID: orderID,
+	})
+}
 
-		fmt.Printf("Batch #%d: Total codes collected: %d\n", batchNumber, batchReadCount)
-		fmt.Printf("Batch #%d: Unique codes in batch: %d\n", batchNumber, len(codesWithFiles))
+// Release hands back the coupon used by a cancelled order. It reports whether
+// there was a redemption to release. ctx must be the transaction that cancels
+// the order, so the release is undone if the cancellation fails.
+func (cs *CouponService) Release(ctx context.Context, orderID string) (bool, error) {
+	redemption, err := cs.models.Coupons.ReleaseRedemption(ctx, orderID)
+	if err != nil {
+		return false, err
+	}
+	return redemption != nil, nil
+}
 
-		appearanceCounts := make(map[int]int)
-		for _, fileList := range codesWithFiles {
-			appearanceCounts[len(fileList)]++
+// couponDiscount applies the coupon's discount rules to the items it is
+// eligible for. The minimum order value is compared with the whole order.
+func couponDiscount(coupon *models.Coupon, items []types.LineItem) (float64, error) {
+	total, eligible := 0.0, 0.0
+	for _, item := range items {
+		total += item.LineTotal
+		if coupon.AppliesTo(item) {
+			eligible += item.LineTotal
 		}
-		fmt.Printf("Batch #%d distribution of code appearances:\n", batchNumber)
-		for appearances, count := range appearanceCounts {
-			fmt.Printf("  Codes appearing in %d file(s): %d\n", appearances, count)
+	}
+
+	if coupon.MinOrderValue > 0 && total < coupon.MinOrderValue {
+		return 0, rejectCoupon(coupon.Code, types.CouponMinOrderNotMet, "order total must be at least %.2f", coupon.MinOrderValue)
+	}
+	if eligible <= 0 {
+		return 0, rejectCoupon(coupon.Code, types.CouponNotApplicable, "coupon does not apply to any item in the order")
+	}
+
+	var discount float64
+	couponType, value := coupon.DiscountType()
+	switch couponType {
+	case types.CouponTypePercentage:
+		discount = eligible * value / 100
+		if coupon.MaxDiscount > 0 && discount > coupon.MaxDiscount {
+			discount = coupon.MaxDiscount
 		}
+	case types.CouponTypeFixed:
+		discount = math.Min(value, eligible)
+	default:
+		return 0, fmt.Errorf("coupon %s has unknown type %q", coupon.Code, couponType)
+	}
+	return math.Round(discount*100) / 100, nil
+}
 
+// couponCodeRegex limits codes to characters that survive URLs and typing
+var couponCodeRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
 
-		var couponsToInsert []models.Coupon
-		for code, fileList := range codesWithFiles {
-			if len(fileList) >= 2 {
-				couponsToInsert = append(couponsToInsert, models.Coupon{
-					Code:        code,
-					FileList:    fileList,
-					Appearances: len(fileList),
-				})
-			}
+// couponCodeAlphabet leaves out characters that are easily confused, such as
+// 0 and O
+const couponCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const (
+	maxGeneratedCoupons    = 10000
+	defaultGeneratedLength = 8
+	maxGenerateAttempts    = 5
+)
+
+// newCoupon builds a coupon from the rules in request
+func newCoupon(code string, request *types.CouponRequest) models.Coupon {
+	return models.Coupon{
+		Code:                  code,
+		Type:                  request.Type,
+		Value:                 request.Value,
+		MaxDiscount:           request.MaxDiscount,
+		MinOrderValue:         request.MinOrderValue,
+		StartsAt:              request.StartsAt,
+		EndsAt:                request.EndsAt,
+		MaxRedemptions:        request.MaxRedemptions,
+		MaxRedemptionsPerUser: request.MaxRedemptionsPerUser,
+		Categories:            request.Categories,
+		ProductIDs:            request.ProductIDs,
+		Active:                request.Active,
+	}
+}
+
+// validateCouponRules checks that a coupon's rules make sense together
+func validateCouponRules(coupon *models.Coupon) error {
+	switch coupon.Type {
+	case types.CouponTypePercentage:
+		if coupon.Value <= 0 || coupon.Value > 100 {
+			return fmt.Errorf("%w: value of a percentage coupon must be between 0 and 100", ErrInvalidCouponRules)
 		}
+	case types.CouponTypeFixed:
+		if coupon.Value <= 0 {
+			return fmt.Errorf("%w: value must be greater than 0", ErrInvalidCouponRules)
+		}
+		if coupon.MaxDiscount != 0 {
+			return fmt.Errorf("%w: maxDiscount only applies to percentage coupons", ErrInvalidCouponRules)
+		}
+	default:
+		return fmt.Errorf("%w: type must be one of percentage, fixed", ErrInvalidCouponRules)
+	}
 
-		if len(couponsToInsert) > 0 {
-			fmt.Printf("Batch #%d: Found %d codes appearing in multiple files. Inserting to DB...\n",
-				batchNumber, len(couponsToInsert))
-			if err := cs.models.Coupons.OptimizedBulkInsert(ctx, couponsToInsert); err != nil {
-				return fmt.Errorf("failed to insert batch #%d: %v", batchNumber, err)
-			}
+	switch {
+	case coupon.MaxDiscount < 0:
+		return fmt.Errorf("%w: maxDiscount cannot be negative", ErrInvalidCouponRules)
+	case coupon.MinOrderValue < 0:
+		return fmt.Errorf("%w: minOrderValue cannot be negative", ErrInvalidCouponRules)
+	case coupon.MaxRedemptions < 0 || coupon.MaxRedemptionsPerUser < 0:
+		return fmt.Errorf("%w: redemption limits cannot be negative", ErrInvalidCouponRules)
+	case coupon.StartsAt != nil && coupon.EndsAt != nil && !coupon.EndsAt.After(*coupon.StartsAt):
+		return fmt.Errorf("%w: endsAt must be after startsAt", ErrInvalidCouponRules)
+	}
+	return nil
+}
+
+// couponRuleFields splits a coupon's rules into the fields to set and the
+// fields to remove because they are empty
+func couponRuleFields(coupon *models.Coupon) (bson.M, []string) {
+	set := bson.M{"type": coupon.Type, "value": coupon.Value}
+	unset := []string{}
+	optional := []struct {
+		field string
+		value interface{}
+		empty bool
+	}{
+		{"maxDiscount", coupon.MaxDiscount, coupon.MaxDiscount == 0},
+		{"minOrderValue", coupon.MinOrderValue, coupon.MinOrderValue == 0},
+		{"startsAt", coupon.StartsAt, coupon.StartsAt == nil},
+		{"endsAt", coupon.EndsAt, coupon.EndsAt == nil},
+		{"maxRedemptions", coupon.MaxRedemptions, coupon.MaxRedemptions == 0},
+		{"maxRedemptionsPerUser", coupon.MaxRedemptionsPerUser, coupon.MaxRedemptionsPerUser == 0},
+		{"categories", coupon.Categories, len(coupon.Categories) == 0},
+		{"productIds", coupon.ProductIDs, len(coupon.ProductIDs) == 0},
+		{"active", coupon.Active, coupon.Active == nil},
+	}
+	for _, field := range optional {
+		if field.empty {
+			unset = append(unset, field.field)
 		} else {
-			fmt.Printf("Batch #%d: No codes found appearing in multiple files.\n", batchNumber)
+			set[field.field] = field.value
 		}
+	}
+	return set, unset
+}
 
-		batchDuration := time.Since(batchStartTime)
-		fmt.Printf("Batch #%d completed in %v\n", batchNumber, batchDuration)
+func (cs *CouponService) GetCoupon(code string) (*models.Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-		if batchReadCount == 0 {
-			fmt.Println("No more records to process. Finishing...")
-			break
-		}
+	return cs.models.Coupons.GetCoupon(ctx, code)
+}
 
-		totalProcessed += batchSize
-		batchNumber++
+func (cs *CouponService) CreateCoupon(code string, request *types.CouponRequest) (*models.Coupon, error) {
+	if !couponCodeRegex.MatchString(code) {
+		return nil, fmt.Errorf("%w: code must be 3-32 letters, digits, dashes or underscores", ErrInvalidCouponRules)
+	}
+	coupon := newCoupon(code, request)
+	if err := validateCouponRules(&coupon); err != nil {
+		return nil, err
 	}
 
-	totalDuration := time.Since(startTime)
-	fmt.Printf("\nTotal coupon processing completed in %v\n", totalDuration)
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cs.models.Coupons.InsertCoupon(ctx, &coupon); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrCouponExists
+		}
+		return nil, err
+	}
+	return &coupon, nil
 }
 
-// readFileToChannelWithOffset reads a file starting from a specific offset and sends codes to a channel
-func readFileToChannelWithOffset(ctx context.Context, filename string, codes chan<- codeWithFile, offset, limit int) error {
-	file, err := os.Open(filename)
+// UpdateCoupon changes the fields present in patch. Imported codes can be
+// deactivated as they are, but need a type before they can be given rules.
+func (cs *CouponService) UpdateCoupon(code string, patch *types.PatchCouponRequest) (*models.Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coupon, err := cs.models.Coupons.GetCoupon(ctx, code)
 	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	gzReader, err := gzip.NewReader(file)
-	if err != nil {
-		return fmt.Errorf("error creating gzip reader: %v", err)
+	rulesChanged := false
+	if patch.Type != nil {
+		coupon.Type, rulesChanged = *patch.Type, true
+	}
+	if patch.Value != nil {
+		coupon.Value, rulesChanged = *patch.Value, true
+	}
+	if patch.MaxDiscount != nil {
+		coupon.MaxDiscount, rulesChanged = *patch.MaxDiscount, true
+	}
+	if patch.MinOrderValue != nil {
+		coupon.MinOrderValue, rulesChanged = *patch.MinOrderValue, true
+	}
+	if patch.StartsAt != nil {
+		coupon.StartsAt, rulesChanged = patch.StartsAt, true
+	}
+	if patch.EndsAt != nil {
+		coupon.EndsAt, rulesChanged = patch.EndsAt, true
+	}
+	if patch.MaxRedemptions != nil {
+		coupon.MaxRedemptions, rulesChanged = *patch.MaxRedemptions, true
+	}
+	if patch.MaxRedemptionsPerUser != nil {
+		coupon.MaxRedemptionsPerUser, rulesChanged = *patch.MaxRedemptionsPerUser, true
+	}
+	if patch.Categories != nil {
+		coupon.Categories, rulesChanged = *patch.Categories, true
+	}
+	if patch.ProductIDs != nil {
+		coupon.ProductIDs, rulesChanged = *patch.ProductIDs, true
+	}
+	if patch.Active != nil {
+		coupon.Active = patch.Active
+	}
+
+	if !rulesChanged {
+		if patch.Active == nil {
+			return nil, fmt.Errorf("%w: no fields to update", ErrInvalidCouponRules)
+		}
+		return cs.models.Coupons.UpdateCoupon(ctx, code, bson.M{"active": *patch.Active})
 	}
-	defer gzReader.Close()
+	if err := validateCouponRules(coupon); err != nil {
+		return nil, err
+	}
+	set, unset := couponRuleFields(coupon)
+	return cs.models.Coupons.UpdateCoupon(ctx, code, set, unset...)
+}
+
+// DeactivateCoupon switches a coupon off. Orders that already used it keep
+// their discount.
+func (cs *CouponService) DeactivateCoupon(code string) (*models.Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return cs.models.Coupons.UpdateCoupon(ctx, code, bson.M{"active": false})
+}
 
-	scanner := bufio.NewScanner(gzReader)
-	buf := make([]byte, 1024*1024) 
-	scanner.Buffer(buf, 1024*1024)
-	scanner.Split(bufio.ScanWords)
+func randomCouponCode(prefix string, length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := make([]byte, length)
+	for i, b := range buf {
+		// 256 is a multiple of the alphabet size, so every character is
+		// equally likely
+		code[i] = couponCodeAlphabet[int(b)%len(couponCodeAlphabet)]
+	}
+	return prefix + string(code), nil
+}
 
-	skipped := 0
-	for skipped < offset && scanner.Scan() {
-		skipped++
+// GenerateCoupons mints request.Count coupons with unique random codes that
+// share the same rules. Codes that collide with existing ones are replaced.
+func (cs *CouponService) GenerateCoupons(request *types.GenerateCouponsRequest) ([]models.Coupon, error) {
+	length := request.Length
+	if length == 0 {
+		length = defaultGeneratedLength
+	}
+	if request.Count < 1 || request.Count > maxGeneratedCoupons {
+		return nil, fmt.Errorf("%w: count must be between 1 and %d", ErrInvalidCouponRules, maxGeneratedCoupons)
+	}
+	if length < 6 || !couponCodeRegex.MatchString(request.Prefix+strings.Repeat("A", length)) {
+		return nil, fmt.Errorf("%w: codes must have at least 6 random characters and be at most 32 letters, digits, dashes or underscores long", ErrInvalidCouponRules)
+	}
+	template := newCoupon("", &request.CouponRequest)
+	if err := validateCouponRules(&template); err != nil {
+		return nil, err
 	}
 
-	readCount := 0
-	for scanner.Scan() {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
 
-		if readCount >= limit {
-			break
+	created := make([]models.Coupon, 0, request.Count)
+	for attempt := 0; attempt < maxGenerateAttempts && len(created) < request.Count; attempt++ {
+		seen := map[string]bool{}
+		batch := make([]models.Coupon, 0, request.Count-len(created))
+		for len(batch) < request.Count-len(created) {
+			code, err := randomCouponCode(request.Prefix, length)
+			if err != nil {
+				return nil, err
+			}
+			if seen[code] {
+				continue
+			}
+			seen[code] = true
+			coupon := template
+			coupon.Code = code
+			batch = append(batch, coupon)
 		}
 
-		word := strings.TrimSpace(scanner.Text())
-		if len(word) >= 8 && len(word) <= 10 {
-			codes <- codeWithFile{
-				code: word,
-				file: filename,
+		duplicates, err := cs.models.Coupons.InsertGeneratedCoupons(ctx, batch)
+		if err != nil {
+			return created, err
+		}
+		skip := map[int]bool{}
+		for _, index := range duplicates {
+			skip[index] = true
+		}
+		for i, coupon := range batch {
+			if !skip[i] {
+				created = append(created, coupon)
 			}
-			readCount++
 		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error scanning file %s: %v", filename, err)
+	if len(created) < request.Count {
+		return created, fmt.Errorf("only %d of %d unique codes could be generated; use a longer length", len(created), request.Count)
 	}
-
-	return nil
+	return created, nil
 }
 
-func (cs *CouponService) ValidateCode(code string) (bool, float64) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// ListCoupons returns a page of coupons matching query and the code to
+// continue after, or nil on the last page
+func (cs *CouponService) ListCoupons(query types.CouponQuery) ([]models.Coupon, *string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	valid, err := cs.models.Coupons.ValidateCoupon(ctx, code)
+	// Fetch one extra coupon to find out whether there is another page
+	limit := query.Limit
+	query.Limit++
+	coupons, err := cs.models.Coupons.ListCoupons(ctx, query)
 	if err != nil {
-		fmt.Printf("Error validating code: %v\n", err)
-		return false, 0
+		return nil, nil, err
 	}
-
-	if valid {
-		return true, 0.10
+	if len(coupons) <= limit {
+		return coupons, nil, nil
 	}
-	return false, 0
+	coupons = coupons[:limit]
+	next := coupons[limit-1].Code
+	return coupons, &next, nil
 }
 
-func (cs *CouponService) FetchCoupons() ([]models.Coupon, error) {
+// CheckCoupon reports whether a code can be used on a cart worth cartTotal,
+// which is ignored when nil. Anyone can call it, so every rejection other
+// than the minimum order value looks the same, and per-user limits and item
+// restrictions, which need a user and a cart, are left to checkout.
+func (cs *CouponService) CheckCoupon(code string, cartTotal *float64) (*types.CouponCheck, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	coupons, err := cs.models.Coupons.FetchCoupons()
-	if err != nil {
+	check := &types.CouponCheck{Code: code}
+	err := func() error {
+		coupon, err := cs.models.Coupons.GetCoupon(ctx, code)
+		if err == mongo.ErrNoDocuments {
+			return rejectCoupon(code, types.CouponNotFound, "no coupon has this code")
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkCouponValidity(coupon, time.Now()); err != nil {
+			return err
+		}
+		if err := cs.checkRedemptionLimits(ctx, coupon, ""); err != nil {
+			return err
+		}
+		if cartTotal != nil && coupon.MinOrderValue > 0 && *cartTotal < coupon.MinOrderValue {
+			return rejectCoupon(code, types.CouponMinOrderNotMet, "order total must be at least %.2f", coupon.MinOrderValue)
+		}
+		return nil
+	}()
+
+	var rejected *CouponRejectedError
+	switch {
+	case errors.As(err, &rejected):
+		// Only a total too low for the coupon is worth telling apart; any
+		// other reason would say whether the code exists
+		check.Reason = types.CouponNotApplicable
+		if rejected.Reason == types.CouponMinOrderNotMet {
+			check.Reason = rejected.Reason
+		}
+	case err != nil:
 		return nil, err
+	default:
+		check.Applicable = true
 	}
-	return coupons, nil
+	return check, nil
 }
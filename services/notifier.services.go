@@ -0,0 +1,70 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notification is a message for a user, such as a password reset email
+type Notification struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// Notifier delivers notifications to users. Production deployments plug in a
+// mail provider; LogNotifier and FileNotifier are for local development.
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// LogNotifier prints notifications to stdout. Bodies carry live reset and
+// verification links, so only the recipient and subject are printed unless
+// IncludeBody is set for local development.
+type LogNotifier struct {
+	IncludeBody bool
+}
+
+func (ln LogNotifier) Notify(notification Notification) error {
+	if !ln.IncludeBody {
+		fmt.Printf("notification to %s: %s (body not logged)\n", notification.To, notification.Subject)
+		return nil
+	}
+	fmt.Printf("notification to %s: %s\n%s\n", notification.To, notification.Subject, notification.Body)
+	return nil
+}
+
+// FileNotifier appends notifications to a file as JSON lines
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (fn *FileNotifier) Notify(notification Notification) error {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	file, err := os.OpenFile(fn.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(notification)
+}
+
+// NewNotifier returns the notifier named by kind, "log" or "file". logBodies
+// makes the log notifier print message bodies.
+func NewNotifier(kind string, path string, logBodies bool) (Notifier, error) {
+	switch kind {
+	case "", "log":
+		return LogNotifier{IncludeBody: logBodies}, nil
+	case "file":
+		return &FileNotifier{Path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", kind)
+}
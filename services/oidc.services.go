@@ -0,0 +1,449 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"foodie-service/config"
+	"foodie-service/models"
+	"foodie-service/types"
+	"foodie-service/utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var (
+	ErrUnknownOIDCProvider     = errors.New("unknown identity provider")
+	ErrInvalidOIDCState        = errors.New("login session is invalid or expired, start the login again")
+	ErrOIDCLoginFailed         = errors.New("identity provider login failed")
+	ErrOIDCEmailNotVerified    = errors.New("identity provider did not confirm the email address")
+	ErrOIDCProviderUnavailable = errors.New("identity provider could not be reached")
+)
+
+const (
+	// oidcDiscoveryTTL is how long a provider's discovery document is reused
+	oidcDiscoveryTTL = time.Hour
+	// oidcKeysMinRefresh limits how often an unknown key id makes us fetch
+	// the provider's keys again
+	oidcKeysMinRefresh = time.Minute
+)
+
+// oidcSigningMethods are the ID token algorithms accepted from providers
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// oidcDiscovery is the part of a provider's
+// /.well-known/openid-configuration document the login flow uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	fetchedAt             time.Time
+}
+
+type oidcKeySet struct {
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+// find returns the key with the given id. A provider with a single key may
+// leave the id out of its tokens.
+func (ks *oidcKeySet) find(kid string) (interface{}, bool) {
+	if key, ok := ks.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// idTokenClaims are the ID token claims checked on login. Some providers
+// send email_verified as the string "true".
+type idTokenClaims struct {
+	Email           string      `json:"email"`
+	EmailVerified   interface{} `json:"email_verified"`
+	Name            string      `json:"name"`
+	Nonce           string      `json:"nonce"`
+	AuthorizedParty string      `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	switch verified := c.EmailVerified.(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+// OIDCService signs users in with OpenID Connect providers using the
+// authorization code flow with PKCE. Discovery documents and provider keys
+// are cached in memory.
+type OIDCService struct {
+	models    *models.BaseModel
+	auth      *AuthService
+	client    *http.Client
+	mu        sync.Mutex
+	discovery map[string]*oidcDiscovery
+	keys      map[string]*oidcKeySet
+}
+
+func NewOIDCService(models *models.BaseModel, auth *AuthService) *OIDCService {
+	return &OIDCService{
+		models:    models,
+		auth:      auth,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		discovery: map[string]*oidcDiscovery{},
+		keys:      map[string]*oidcKeySet{},
+	}
+}
+
+func (oidc *OIDCService) provider(name string) (config.OIDCProvider, error) {
+	for _, provider := range config.GetConfig().OIDCProviders {
+		if provider.Name == strings.ToLower(name) {
+			return provider, nil
+		}
+	}
+	return config.OIDCProvider{}, ErrUnknownOIDCProvider
+}
+
+func (oidc *OIDCService) getJSON(endpoint string, target interface{}) error {
+	resp, err := oidc.client.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOIDCProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrOIDCProviderUnavailable, endpoint, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return fmt.Errorf("%w: invalid response from %s: %v", ErrOIDCProviderUnavailable, endpoint, err)
+	}
+	return nil
+}
+
+// discover returns the provider's discovery document, which must name the
+// configured issuer
+func (oidc *OIDCService) discover(provider config.OIDCProvider) (*oidcDiscovery, error) {
+	oidc.mu.Lock()
+	cached := oidc.discovery[provider.Name]
+	oidc.mu.Unlock()
+	if cached != nil && time.Since(cached.fetchedAt) < oidcDiscoveryTTL {
+		return cached, nil
+	}
+
+	var discovery oidcDiscovery
+	endpoint := strings.TrimSuffix(provider.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := oidc.getJSON(endpoint, &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(provider.Issuer, "/") {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", ErrOIDCProviderUnavailable, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document is missing endpoints", ErrOIDCProviderUnavailable)
+	}
+
+	discovery.fetchedAt = time.Now()
+	oidc.mu.Lock()
+	oidc.discovery[provider.Name] = &discovery
+	oidc.mu.Unlock()
+	return &discovery, nil
+}
+
+// signingKey returns the provider key with the given id. Providers rotate
+// keys, so an unknown id fetches the key set again.
+func (oidc *OIDCService) signingKey(provider config.OIDCProvider, discovery *oidcDiscovery, kid string) (interface{}, error) {
+	oidc.mu.Lock()
+	cached := oidc.keys[provider.Name]
+	oidc.mu.Unlock()
+	if cached != nil {
+		if key, ok := cached.find(kid); ok {
+			return key, nil
+		}
+		if time.Since(cached.fetchedAt) < oidcKeysMinRefresh {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+	}
+
+	var jwks types.JWKS
+	if err := oidc.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keySet := &oidcKeySet{keys: map[string]interface{}{}, fetchedAt: time.Now()}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := utils.ParsePublicJWK(jwk)
+		if err != nil {
+			// Skip key types we cannot use rather than failing every login
+			continue
+		}
+		keySet.keys[jwk.Kid] = key
+	}
+	oidc.mu.Lock()
+	oidc.keys[provider.Name] = keySet
+	oidc.mu.Unlock()
+
+	if key, ok := keySet.find(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// LoginURL starts a login with a provider and returns the provider URL the
+// user should be sent to
+func (oidc *OIDCService) LoginURL(providerName string) (string, error) {
+	provider, err := oidc.provider(providerName)
+	if err != nil {
+		return "", err
+	}
+	discovery, err := oidc.discover(provider)
+	if err != nil {
+		return "", err
+	}
+
+	state, _, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, _, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, _, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = oidc.models.OIDC.InsertOIDCState(&models.OIDCStateSchema{
+		State:        state,
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(config.GetConfig().OIDCStateTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {provider.RedirectURL},
+		"scope":                 {strings.Join(provider.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Callback finishes a login when the provider redirects back. providerError
+// is the error parameter the provider sends when the user did not sign in.
+func (oidc *OIDCService) Callback(providerName, code, state, providerError string) (*types.SignInResponse, error) {
+	provider, err := oidc.provider(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Consume the state first so it cannot be replayed even when the
+	// provider reports an error
+	stored, err := oidc.models.OIDC.ConsumeOIDCState(state)
+	if err == mongo.ErrNoDocuments || (err == nil && stored.Provider != provider.Name) {
+		return nil, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return nil, err
+	}
+	if providerError != "" {
+		return nil, fmt.Errorf("%w: %s", ErrOIDCLoginFailed, providerError)
+	}
+	if code == "" {
+		return nil, fmt.Errorf("%w: no authorization code was returned", ErrOIDCLoginFailed)
+	}
+
+	discovery, err := oidc.discover(provider)
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, err := oidc.exchangeCode(provider, discovery, code, stored.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := oidc.verifyIDToken(provider, discovery, rawIDToken, stored.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := oidc.userForIdentity(provider.Name, claims)
+	if err != nil {
+		return nil, err
+	}
+	return oidc.auth.issueTokens(user, uuid.New().String())
+}
+
+// exchangeCode redeems an authorization code at the provider's token endpoint
+// and returns the ID token
+func (oidc *OIDCService) exchangeCode(provider config.OIDCProvider, discovery *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.RedirectURL},
+		"client_id":     {provider.ClientID},
+		"code_verifier": {verifier},
+	}
+	if provider.ClientSecret != "" {
+		form.Set("client_secret", provider.ClientSecret)
+	}
+
+	resp, err := oidc.client.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOIDCProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	var tokenResponse struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("%w: invalid token response: %v", ErrOIDCProviderUnavailable, err)
+	}
+	if tokenResponse.Error != "" {
+		return "", fmt.Errorf("%w: %s %s", ErrOIDCLoginFailed, tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: token endpoint returned %s", ErrOIDCProviderUnavailable, resp.Status)
+	}
+	if tokenResponse.IDToken == "" {
+		return "", fmt.Errorf("%w: no ID token was returned", ErrOIDCLoginFailed)
+	}
+	return tokenResponse.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry and
+// nonce
+func (oidc *OIDCService) verifyIDToken(provider config.OIDCProvider, discovery *oidcDiscovery, rawIDToken, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidc.signingKey(provider, discovery, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(provider.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if errors.Is(err, ErrOIDCProviderUnavailable) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token: %v", ErrOIDCLoginFailed, err)
+	}
+
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: ID token nonce does not match", ErrOIDCLoginFailed)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != provider.ClientID {
+		return nil, fmt.Errorf("%w: ID token was issued to another client", ErrOIDCLoginFailed)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrOIDCLoginFailed)
+	}
+	return claims, nil
+}
+
+// userForIdentity finds the user linked to the provider account. Otherwise
+// the account is linked to the user with the same email, or a new user is
+// created, but only when the provider has verified the email.
+func (oidc *OIDCService) userForIdentity(provider string, claims *idTokenClaims) (*models.UserSchema, error) {
+	user, err := oidc.models.Auth.GetUserByIdentity(provider, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if email == "" || !claims.emailVerified() {
+		return nil, ErrOIDCEmailNotVerified
+	}
+	identity := models.Identity{Provider: provider, Subject: claims.Subject, Email: email}
+
+	// Two callbacks for a new user can race; the loser finds the winner's user
+	for attempt := 0; attempt < 2; attempt++ {
+		existing, err := oidc.models.Auth.GetUserByEmail(email)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+
+		if existing != nil {
+			user, err = oidc.models.Auth.LinkIdentity(existing.UserID, identity)
+			if mongo.IsDuplicateKeyError(err) {
+				return oidc.models.Auth.GetUserByIdentity(provider, claims.Subject)
+			}
+			if err != nil {
+				return nil, err
+			}
+			// Sessions started with the password of an unverified account
+			// may belong to someone else
+			if !existing.Verified {
+				if err := oidc.models.Tokens.RevokeUserRefreshTokens(tokenSubject(user)); err != nil {
+					return nil, err
+				}
+			}
+			// The provider has confirmed the email, so a listed admin can be
+			// promoted now
+			return promoteBootstrapAdmin(oidc.models, user)
+		}
+
+		now := time.Now()
+		user = &models.UserSchema{
+			Email:      email,
+			Name:       claims.Name,
+			Identities: []models.Identity{{Provider: provider, Subject: claims.Subject, Email: email, LinkedAt: now}},
+			Role:       types.RoleCustomer,
+			Verified:   true,
+			VerifiedAt: &now,
+		}
+		if isBootstrapAdmin(email) {
+			user.Role = types.RoleAdmin
+		}
+		user, err = oidc.models.Auth.CreateUser(user)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	return oidc.models.Auth.GetUserByIdentity(provider, claims.Subject)
+}
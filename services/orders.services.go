@@ -2,31 +2,139 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"foodie-service/config"
 	"foodie-service/models"
 	"foodie-service/types"
-    "math"
+	"math"
+	"strings"
+	"time"
+
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var (
+	ErrInvalidOrderStatus      = errors.New("unknown order status")
+	ErrInvalidStatusTransition = errors.New("order status transition is not allowed")
+	ErrOrderStatusConflict     = errors.New("order status was changed concurrently, retry with the latest order")
+	ErrCancellationNotAllowed  = errors.New("order can no longer be cancelled")
+	ErrIdempotencyKeyReused    = errors.New("idempotency key was already used with a different request body")
+	ErrIdempotencyKeyInFlight  = errors.New("a request with this idempotency key is still being processed")
+	ErrEmailNotVerified        = errors.New("verify your email address before placing orders")
 )
 
+// orderStatusSequence is the forward progression of an order, used to decide
+// whether an order has reached a given stage
+var orderStatusSequence = []types.OrderStatus{
+	types.OrderStatusPlaced,
+	types.OrderStatusConfirmed,
+	types.OrderStatusPreparing,
+	types.OrderStatusOutForDelivery,
+	types.OrderStatusDelivered,
+}
+
+func orderStatusRank(status types.OrderStatus) int {
+	for i, s := range orderStatusSequence {
+		if s == status {
+			return i
+		}
+	}
+	return len(orderStatusSequence)
+}
+
+// CheckOrderConfig fails when ORDER_CANCEL_BEFORE_STATUS is not one of the
+// stages in orderStatusSequence. An unknown status would rank after every
+// stage and let customers cancel orders at any status, even once delivered.
+func CheckOrderConfig() error {
+	cutoff := types.OrderStatus(config.GetConfig().OrderCancelBeforeStatus)
+	for _, status := range orderStatusSequence {
+		if status == cutoff {
+			return nil
+		}
+	}
+	return fmt.Errorf("ORDER_CANCEL_BEFORE_STATUS %q must be one of placed, confirmed, preparing, out_for_delivery, delivered", cutoff)
+}
+
+// orderStatusTransitions lists, for every status, the statuses an order may
+// move to next
+var orderStatusTransitions = map[types.OrderStatus][]types.OrderStatus{
+	types.OrderStatusPlaced:         {types.OrderStatusConfirmed, types.OrderStatusCancelled},
+	types.OrderStatusConfirmed:      {types.OrderStatusPreparing, types.OrderStatusCancelled},
+	types.OrderStatusPreparing:      {types.OrderStatusOutForDelivery, types.OrderStatusCancelled},
+	types.OrderStatusOutForDelivery: {types.OrderStatusDelivered},
+	types.OrderStatusDelivered:      {types.OrderStatusRefunded},
+	types.OrderStatusCancelled:      {types.OrderStatusRefunded},
+	types.OrderStatusRefunded:       {},
+}
+
+func CanTransitionOrderStatus(from, to types.OrderStatus) bool {
+	for _, next := range orderStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
 type OrdersService struct {
-	models *models.BaseModel
+	models  *models.BaseModel
+	coupons *CouponService
 }
 
 var ordersService *OrdersService
 
-func NewOrdersService(models *models.BaseModel) *OrdersService {
+func NewOrdersService(models *models.BaseModel, coupons *CouponService) *OrdersService {
 	if ordersService != nil {
 		return ordersService
 	}
 
 	ordersService= &OrdersService{
-		models: models,
+		models:  models,
+		coupons: coupons,
 	}
 	return ordersService
 }
 
+// OutOfStockError is returned when an order asks for more units of a
+// stock-tracked product than are left
+type OutOfStockError struct {
+	Items []types.OutOfStockItem
+}
+
+func (e *OutOfStockError) Error() string {
+	ids := make([]string, len(e.Items))
+	for i, item := range e.Items {
+		ids[i] = item.ProductID
+	}
+	return fmt.Sprintf("insufficient stock for products: %s", strings.Join(ids, ", "))
+}
+
 func (os *OrdersService) PlaceOrder(order *types.BulkOrdersRequest, userID string) (*types.PurchaseDetails, error) {
+	return os.placeOrder(order, userID, nil)
+}
+
+// afterInsertFunc runs in the transaction that stores an order
+type afterInsertFunc func(ctx context.Context, purchaseDetails *types.PurchaseDetails) error
+
+// placeOrder places an order and, when afterInsert is set, runs it in the
+// transaction that stores the order, so that whatever it writes is kept only
+// if the order is
+func (os *OrdersService) placeOrder(order *types.BulkOrdersRequest, userID string, afterInsert afterInsertFunc) (*types.PurchaseDetails, error) {
+	user, err := userForSubject(os.models, userID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if err := checkCanOrder(user); err != nil {
+		return nil, err
+	}
+	deliveryAddress, err := deliveryAddressFor(user, order.AddressID)
+	if err != nil {
+		return nil, err
+	}
+
 	orderID := uuid.New().String()
 	totalPrice := 0.0
 	discount := 0.0
@@ -34,75 +142,416 @@ func (os *OrdersService) PlaceOrder(order *types.BulkOrdersRequest, userID strin
 	products := []types.Product{}
 
 	// Calculate total price and get products
+	quantities := map[string]int{}
+	productOrder := []string{}
 	for _, item := range order.Items {
-		product, err := os.models.Products.GetProductByProductId(item.ProductID)
-		if err != nil {
-			return nil, err
+		if _, seen := quantities[item.ProductID]; !seen {
+			productOrder = append(productOrder, item.ProductID)
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+
+	productsByID, err := os.models.Products.GetProductsByIds(productOrder)
+	if err != nil {
+		return nil, err
+	}
+	stock := map[string]*int{}
+	lineItems := make([]types.LineItem, 0, len(order.Items))
+	for _, item := range order.Items {
+		product, ok := productsByID[item.ProductID]
+		if !ok || product.Archived {
+			return nil, mongo.ErrNoDocuments
 		}
-		products = append(products, *product)
-		totalPrice += product.Price * float64(item.Quantity)
+		products = append(products, product)
+		lineItem := newLineItem(product, item.Quantity)
+		lineItem.StockReserved = product.Stock != nil
+		lineItems = append(lineItems, lineItem)
+		totalPrice += lineItem.LineTotal
+		stock[item.ProductID] = product.Stock
 	}
 
 	// Validate and apply coupon code if provided
 	if order.CouponCode != "" {
-		isValid, err := os.models.Coupons.ValidateCoupon(context.Background(), order.CouponCode)
+		discount, err = os.coupons.Evaluate(order.CouponCode, userID, lineItems)
 		if err != nil {
 			return nil, err
 		}
-		if isValid {
-			discount = math.Round(float64(totalPrice)*0.10 * 100) / 100
-		} else {
-			return nil, fmt.Errorf("invalid coupon code: %s", order.CouponCode)
-		}
 	}
 
 	finalPrice = totalPrice - discount
 
 	purchaseDetails := &types.PurchaseDetails{
 		OrderID:    orderID,
-		Items:      order.Items,
-		Products:   products,
+		Items:      lineItems,
 		TotalPrice: totalPrice,
 		Discount:   discount,
 		FinalPrice: finalPrice,
 		CouponCode: order.CouponCode,
 	}
+	if deliveryAddress != nil {
+		address := toAddress(*deliveryAddress)
+		purchaseDetails.DeliveryAddress = &address
+	}
 
-	purchaseDetails, err := os.models.Orders.InsertOrder(purchaseDetails, userID)
+	// Take stock, redeem the coupon and record the order together so a
+	// failure part way through never leaves units reserved or a coupon used
+	// by an order that does not exist
+	err = os.models.WithTransaction(context.Background(), func(ctx context.Context) error {
+		outOfStock := &OutOfStockError{}
+		for _, productID := range productOrder {
+			if stock[productID] == nil {
+				continue
+			}
+			reserved, err := os.models.Products.ReserveStock(ctx, productID, quantities[productID])
+			if err != nil {
+				return err
+			}
+			if !reserved {
+				outOfStock.Items = append(outOfStock.Items, types.OutOfStockItem{
+					ProductID: productID,
+					Requested: quantities[productID],
+					Available: *stock[productID],
+				})
+			}
+		}
+		if len(outOfStock.Items) > 0 {
+			return outOfStock
+		}
+
+		if order.CouponCode != "" {
+			if err := os.coupons.Redeem(ctx, order.CouponCode, userID, orderID); err != nil {
+				return err
+			}
+		}
+
+		inserted, err := os.models.Orders.InsertOrder(ctx, purchaseDetails, userID)
+		if err != nil {
+			return err
+		}
+		inserted.Products = products
+		purchaseDetails = inserted
+		if afterInsert != nil {
+			return afterInsert(ctx, purchaseDetails)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	purchaseDetails.Products = products
 
 	return purchaseDetails, nil
 }
 
-func (os *OrdersService) GetPreviousOrders(userID string, limit, offset int)(*[]types.PurchaseDetails, error) {
-  orderSchemas, err := os.models.Orders.GetOrders(userID, limit, offset)
-  if err != nil {
-    return nil, err
-  }
+// checkCanOrder rejects users with unverified emails when
+// REQUIRE_VERIFIED_EMAIL_FOR_ORDERS is set. user is nil when the account no
+// longer exists.
+func checkCanOrder(user *models.UserSchema) error {
+	if !config.GetConfig().RequireVerifiedEmailForOrders {
+		return nil
+	}
+	if user == nil || !user.Verified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
 
-  purchaseDetails := []types.PurchaseDetails{}
-  for _, orderSchema := range orderSchemas {
-	products := []types.Product{}
-	for _, item := range orderSchema.Items {
-		product, err := os.models.Products.GetProductByProductId(item.ProductID)
+// deliveryAddressFor picks the address an order is delivered to: the one named
+// by addressID, or the user's default address when addressID is empty
+func deliveryAddressFor(user *models.UserSchema, addressID string) (*models.Address, error) {
+	if addressID == "" {
+		if user == nil {
+			return nil, nil
+		}
+		return user.DefaultAddress(), nil
+	}
+	if user == nil {
+		return nil, ErrAddressNotFound
+	}
+	address := user.FindAddress(addressID)
+	if address == nil {
+		return nil, ErrAddressNotFound
+	}
+	return address, nil
+}
+
+// PlaceOrderWithIdempotencyKey places an order at most once per key. Replaying
+// a key with the same request hash returns the stored order instead of placing
+// a new one; replaying it with a different request is rejected.
+func (os *OrdersService) PlaceOrderWithIdempotencyKey(order *types.BulkOrdersRequest, userID string, key string, requestHash string) (*types.PurchaseDetails, error) {
+	return os.placeOnce(key, userID, requestHash, func(store afterInsertFunc) (*types.PurchaseDetails, error) {
+		return os.placeOrder(order, userID, store)
+	})
+}
+
+// placeOnce runs place at most once per key, as PlaceOrderWithIdempotencyKey
+// describes. place must run store in the transaction that stores the order, so
+// a key is never left in flight by an order that went through.
+func (os *OrdersService) placeOnce(key string, userID string, requestHash string, place func(store afterInsertFunc) (*types.PurchaseDetails, error)) (*types.PurchaseDetails, error) {
+	record, created, err := os.models.Idempotency.Reserve(key, userID, requestHash)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		if record.RequestHash != requestHash {
+			return nil, ErrIdempotencyKeyReused
+		}
+		if record.Response == nil {
+			return nil, ErrIdempotencyKeyInFlight
+		}
+		return record.Response, nil
+	}
+
+	purchaseDetails, err := place(func(ctx context.Context, purchaseDetails *types.PurchaseDetails) error {
+		return os.models.Idempotency.Complete(ctx, key, userID, purchaseDetails)
+	})
+	if err != nil {
+		if releaseErr := os.models.Idempotency.Release(key, userID); releaseErr != nil {
+			return nil, fmt.Errorf("%w; failed to release idempotency key %s: %v", err, key, releaseErr)
+		}
+		return nil, err
+	}
+	return purchaseDetails, nil
+}
+
+func (os *OrdersService) GetPreviousOrders(userID string, limit, offset int) (*[]types.PurchaseDetails, error) {
+	orderSchemas, err := os.models.Orders.GetOrders(userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	purchaseDetails, err := os.withProducts(orderSchemas...)
+	if err != nil {
+		return nil, err
+	}
+	return &purchaseDetails, nil
+}
+
+func (os *OrdersService) GetOrder(orderID string, userID string) (*types.PurchaseDetails, error) {
+	order, err := os.models.Orders.GetUserOrder(orderID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	purchaseDetails, err := os.withProducts(*order)
+	if err != nil {
+		return nil, err
+	}
+	return &purchaseDetails[0], nil
+}
+
+// newLineItem snapshots the catalogue entry for an ordered product
+func newLineItem(product types.Product, quantity int) types.LineItem {
+	return types.LineItem{
+		ProductID: product.ProductID,
+		Quantity:  quantity,
+		Name:      product.Name,
+		Category:  product.Category,
+		UnitPrice: product.Price,
+		LineTotal: math.Round(product.Price*float64(quantity)*100) / 100,
+		Thumbnail: product.Image.Thumbnail,
+	}
+}
+
+// withProducts converts orders to purchase details, building the products of
+// each order from its line item snapshots. Items stored before snapshots
+// existed are filled in from the current catalogue with a single query; if
+// such a product has since been removed it is left out.
+func (os *OrdersService) withProducts(orderSchemas ...models.OrderSchema) ([]types.PurchaseDetails, error) {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, orderSchema := range orderSchemas {
+		for _, item := range orderSchema.Items {
+			if !item.HasSnapshot() && !seen[item.ProductID] {
+				seen[item.ProductID] = true
+				ids = append(ids, item.ProductID)
+			}
+		}
+	}
+
+	productsByID, err := os.models.Products.GetProductsByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	purchaseDetails := []types.PurchaseDetails{}
+	for _, orderSchema := range orderSchemas {
+		details := orderSchema.ToPurchaseDetails()
+		details.Products = []types.Product{}
+		for i, item := range details.Items {
+			if !item.HasSnapshot() {
+				product, ok := productsByID[item.ProductID]
+				if !ok {
+					continue
+				}
+				item = newLineItem(product, item.Quantity)
+				details.Items[i] = item
+			}
+			details.Products = append(details.Products, types.Product{
+				ProductID: item.ProductID,
+				Image:     types.Image{Thumbnail: item.Thumbnail},
+				Name:      item.Name,
+				Category:  item.Category,
+				Price:     item.UnitPrice,
+			})
+		}
+		purchaseDetails = append(purchaseDetails, *details)
+	}
+	return purchaseDetails, nil
+}
+
+func (os *OrdersService) UpdateOrderStatus(orderID string, status types.OrderStatus, note string, changedBy string) (*types.PurchaseDetails, error) {
+	if _, ok := orderStatusTransitions[status]; !ok {
+		return nil, ErrInvalidOrderStatus
+	}
+
+	order, err := os.models.Orders.GetOrderByOrderId(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := order.CurrentStatus()
+	if !CanTransitionOrderStatus(current, status) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidStatusTransition, current, status)
+	}
+
+	event := models.OrderStatusEvent{
+		From:      current,
+		To:        status,
+		ChangedBy: changedBy,
+		Note:      note,
+		ChangedAt: time.Now(),
+	}
+	if status == types.OrderStatusCancelled {
+		updated, err := os.cancel(order, note, changedBy, event, func(ctx context.Context, cancellation *models.OrderCancellation, refund *models.OrderRefund) (*models.OrderSchema, error) {
+			fields := bson.M{"cancellation": cancellation, "refund": refund}
+			return os.models.Orders.UpdateOrderStatus(ctx, orderID, current, event, fields)
+		})
 		if err != nil {
 			return nil, err
 		}
-		products = append(products, *product)
+		return updated.ToPurchaseDetails(), nil
+	}
+
+	var fields bson.M
+	if status == types.OrderStatusRefunded {
+		refund := order.Refund
+		if refund == nil {
+			refund = &models.OrderRefund{Amount: order.FinalPrice, CouponCode: order.CouponCode, CreatedAt: event.ChangedAt}
+		}
+		refund.Status = types.RefundStatusCompleted
+		refund.CompletedAt = &event.ChangedAt
+		fields = bson.M{"refund": refund}
 	}
-    purchaseDetails = append(purchaseDetails, types.PurchaseDetails{
-      OrderID: orderSchema.OrderID,
-      Items: orderSchema.Items,
-      TotalPrice: orderSchema.TotalPrice,
-      Discount: orderSchema.Discount,
-      FinalPrice: orderSchema.FinalPrice,
-	  CouponCode: orderSchema.CouponCode,
-	  Products: products,
-    })
-  }
 
-  return &purchaseDetails, nil
+	updated, err := os.models.Orders.UpdateOrderStatus(context.Background(), orderID, current, event, fields)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrOrderStatusConflict
+		}
+		return nil, err
+	}
+	return updated.ToPurchaseDetails(), nil
+}
+
+// CancelOrder cancels one of the user's own orders. Customers may cancel while
+// the order is still within the configured cancellation window, or at any time
+// before it reaches the configured cut-off status.
+func (os *OrdersService) CancelOrder(orderID string, userID string, reason string) (*types.PurchaseDetails, error) {
+	order, err := os.models.Orders.GetUserOrder(orderID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := order.CurrentStatus()
+	if !CanTransitionOrderStatus(current, types.OrderStatusCancelled) {
+		return nil, fmt.Errorf("%w: order is %s", ErrCancellationNotAllowed, current)
+	}
+
+	cfg := config.GetConfig()
+	now := time.Now()
+	withinWindow := cfg.OrderCancellationWindow > 0 && now.Sub(order.InsertedAt) <= cfg.OrderCancellationWindow
+	beforeCutoff := orderStatusRank(current) < orderStatusRank(types.OrderStatus(cfg.OrderCancelBeforeStatus))
+	if !withinWindow && !beforeCutoff {
+		return nil, fmt.Errorf("%w: order is %s", ErrCancellationNotAllowed, current)
+	}
+
+	event := models.OrderStatusEvent{
+		From:      current,
+		To:        types.OrderStatusCancelled,
+		ChangedBy: userID,
+		Note:      reason,
+		ChangedAt: now,
+	}
+	updated, err := os.cancel(order, reason, userID, event, func(ctx context.Context, cancellation *models.OrderCancellation, refund *models.OrderRefund) (*models.OrderSchema, error) {
+		return os.models.Orders.CancelOrder(ctx, orderID, userID, current, event, cancellation, refund)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated.ToPurchaseDetails(), nil
+}
+
+// cancel runs update, which moves the order to cancelled, in one transaction
+// with handing back the coupon and the stock the order reserved. The status
+// update only matches while the order is still in the status it was read in,
+// so a concurrent change aborts the whole transaction and nothing is released
+// twice. The stored refund says whether a coupon was actually released.
+func (os *OrdersService) cancel(order *models.OrderSchema, reason string, cancelledBy string, event models.OrderStatusEvent, update func(ctx context.Context, cancellation *models.OrderCancellation, refund *models.OrderRefund) (*models.OrderSchema, error)) (*models.OrderSchema, error) {
+	var updated *models.OrderSchema
+	err := os.models.WithTransaction(context.Background(), func(ctx context.Context) error {
+		cancellation, refund := newCancellation(order, reason, cancelledBy, event.ChangedAt)
+		if order.CouponCode != "" {
+			released, err := os.coupons.Release(ctx, order.OrderID)
+			if err != nil {
+				return err
+			}
+			refund.CouponReleased = released
+		}
+
+		var err error
+		updated, err = update(ctx, cancellation, refund)
+		if err != nil {
+			return err
+		}
+		return os.releaseStock(ctx, updated)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOrderStatusConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// releaseStock puts back the units reserved by a cancelled order. Items of
+// products that were not stock-tracked when the order was placed are skipped.
+func (os *OrdersService) releaseStock(ctx context.Context, order *models.OrderSchema) error {
+	for _, item := range order.Items {
+		if !item.StockReserved {
+			continue
+		}
+		if err := os.models.Products.ReleaseStock(ctx, item.ProductID, item.Quantity); err != nil {
+			return fmt.Errorf("failed to release stock of product %s: %w", item.ProductID, err)
+		}
+	}
+	return nil
+}
+
+// newCancellation builds the cancellation and refund records for an order.
+// The whole amount paid is refunded; CouponReleased is set by cancel once the
+// coupon has been handed back.
+func newCancellation(order *models.OrderSchema, reason string, cancelledBy string, at time.Time) (*models.OrderCancellation, *models.OrderRefund) {
+	cancellation := &models.OrderCancellation{
+		Reason:      reason,
+		CancelledBy: cancelledBy,
+		CancelledAt: at,
+	}
+	refund := &models.OrderRefund{
+		Amount:     order.FinalPrice,
+		CouponCode: order.CouponCode,
+		Status:     types.RefundStatusPending,
+		CreatedAt:  at,
+	}
+	return cancellation, refund
 }
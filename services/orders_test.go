@@ -0,0 +1,187 @@
+//go:build integration
+
+// The benchmarks in this file need a MongoDB replica set at MONGO_URI and
+// write to its foodie database, removing what they created afterwards:
+//
+//	go test -tags integration -run '^$' -bench ProductLookups ./services
+//
+// They count the find commands sent to the products collection and report
+// them as productFinds/op, failing if an order flow needs more than one.
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"foodie-service/config"
+	"foodie-service/database"
+	"foodie-service/models"
+	"foodie-service/types"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	benchProducts      = 10
+	benchHistoryOrders = 5
+)
+
+// productFinds counts the find commands sent to the products collection
+type productFinds struct {
+	count atomic.Int64
+}
+
+func (pf *productFinds) monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			if e.CommandName != "find" {
+				return
+			}
+			if collection, ok := e.Command.Lookup("find").StringValueOK(); ok && collection == "products" {
+				pf.count.Add(1)
+			}
+		},
+	}
+}
+
+var (
+	benchOnce   sync.Once
+	benchClient *mongo.Client
+	benchModels *models.BaseModel
+	benchFinds  = &productFinds{}
+	benchErr    error
+)
+
+// setupLookupBenchmark connects to MongoDB with finds counted, once for all
+// benchmarks since the models are shared, and stores benchProducts products
+// for a new user. It returns the models, the product ids and the user id.
+func setupLookupBenchmark(b *testing.B) (*models.BaseModel, []string, string) {
+	b.Helper()
+
+	benchOnce.Do(func() {
+		opts := options.Client().ApplyURI(config.GetConfig().MONGO_URI).SetMonitor(benchFinds.monitor())
+		benchClient, benchErr = mongo.Connect(opts)
+		if benchErr != nil {
+			return
+		}
+		if benchErr = benchClient.Ping(context.Background(), nil); benchErr != nil {
+			return
+		}
+		db := &database.Mongo{MongoClient: benchClient}
+		benchModels = models.NewBaseModel(db, db)
+	})
+	if benchErr != nil {
+		b.Skipf("MongoDB is not reachable at %s: %v", config.GetConfig().MONGO_URI, benchErr)
+	}
+
+	run := uuid.New().String()
+	userID := "bench-user-" + run
+	ids := make([]string, benchProducts)
+	products := make([]types.Product, benchProducts)
+	for i := range products {
+		ids[i] = fmt.Sprintf("bench-%s-%d", run, i)
+		products[i] = types.Product{
+			ProductID: ids[i],
+			Name:      fmt.Sprintf("Bench product %d", i),
+			Category:  "Bench",
+			Price:     float64(i + 1),
+		}
+	}
+	if err := benchModels.Products.InsertBulkProducts(products); err != nil {
+		b.Fatalf("failed to insert products: %v", err)
+	}
+
+	b.Cleanup(func() {
+		ctx := context.Background()
+		foodie := benchClient.Database("foodie")
+		foodie.Collection("products").DeleteMany(ctx, bson.M{"productId": bson.M{"$in": ids}})
+		foodie.Collection("orders").DeleteMany(ctx, bson.M{"userId": userID})
+	})
+	return benchModels, ids, userID
+}
+
+// reportFinds reports the product finds per operation and fails when they
+// exceed limit
+func reportFinds(b *testing.B, limit int) {
+	b.Helper()
+	perOp := float64(benchFinds.count.Load()) / float64(b.N)
+	b.ReportMetric(perOp, "productFinds/op")
+	if perOp > float64(limit) {
+		b.Fatalf("expected at most %d product finds per operation, got %.1f", limit, perOp)
+	}
+}
+
+// BenchmarkPerItemProductLookups is the lookup pattern the order flows used
+// before GetProductsByIds: one find per line item of a history page
+func BenchmarkPerItemProductLookups(b *testing.B) {
+	baseModels, ids, _ := setupLookupBenchmark(b)
+
+	b.ResetTimer()
+	benchFinds.count.Store(0)
+	for i := 0; i < b.N; i++ {
+		for order := 0; order < benchHistoryOrders; order++ {
+			for _, id := range ids {
+				if _, err := baseModels.Products.GetProductByProductId(id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	reportFinds(b, benchHistoryOrders*benchProducts)
+}
+
+func BenchmarkPlaceOrderProductLookups(b *testing.B) {
+	baseModels, ids, userID := setupLookupBenchmark(b)
+	orders := &OrdersService{models: baseModels, coupons: &CouponService{models: baseModels}}
+
+	request := &types.BulkOrdersRequest{}
+	for _, id := range ids {
+		request.Items = append(request.Items, types.Order{ProductID: id, Quantity: 1})
+	}
+
+	b.ResetTimer()
+	benchFinds.count.Store(0)
+	for i := 0; i < b.N; i++ {
+		if _, err := orders.PlaceOrder(request, userID); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportFinds(b, 1)
+}
+
+func BenchmarkGetPreviousOrdersProductLookups(b *testing.B) {
+	baseModels, ids, userID := setupLookupBenchmark(b)
+	orders := &OrdersService{models: baseModels}
+
+	// Items without snapshots, as stored before line items carried them, are
+	// the ones that have to be looked up in the catalogue
+	for order := 0; order < benchHistoryOrders; order++ {
+		details := &types.PurchaseDetails{OrderID: uuid.New().String()}
+		for _, id := range ids {
+			details.Items = append(details.Items, types.LineItem{ProductID: id, Quantity: 1})
+		}
+		if _, err := baseModels.Orders.InsertOrder(context.Background(), details, userID); err != nil {
+			b.Fatalf("failed to insert order: %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	benchFinds.count.Store(0)
+	for i := 0; i < b.N; i++ {
+		history, err := orders.GetPreviousOrders(userID, benchHistoryOrders, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(*history) != benchHistoryOrders {
+			b.Fatalf("expected %d orders, got %d", benchHistoryOrders, len(*history))
+		}
+	}
+	reportFinds(b, 1)
+}
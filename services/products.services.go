@@ -1,9 +1,16 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"foodie-service/models"
+	"foodie-service/types"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
+var ErrInvalidProductUpdate = errors.New("invalid product update")
+
 type ProductsService struct {
 	models *models.BaseModel
 }
@@ -14,4 +21,61 @@ func NewProductsService(models *models.BaseModel) *ProductsService {
 	}
 }
 
+// ReplaceProduct overwrites every editable field of a product
+func (ps *ProductsService) ReplaceProduct(productID string, product *types.UpdateProductRequest) (*types.Product, error) {
+	if product.Stock != nil && *product.Stock < 0 {
+		return nil, fmt.Errorf("%w: stock cannot be negative", ErrInvalidProductUpdate)
+	}
+
+	set := bson.M{
+		"image":    models.Image(product.Image),
+		"name":     product.Name,
+		"category": product.Category,
+		"price":    product.Price,
+	}
+	if product.Stock == nil {
+		return ps.models.Products.UpdateProduct(productID, set, "stock")
+	}
+	set["stock"] = *product.Stock
+	return ps.models.Products.UpdateProduct(productID, set)
+}
+
+// PatchProduct changes only the fields present in the request
+func (ps *ProductsService) PatchProduct(productID string, patch *types.PatchProductRequest) (*types.Product, error) {
+	set := bson.M{}
+	if patch.Image != nil {
+		set["image"] = models.Image(*patch.Image)
+	}
+	if patch.Name != nil {
+		if *patch.Name == "" {
+			return nil, fmt.Errorf("%w: name cannot be empty", ErrInvalidProductUpdate)
+		}
+		set["name"] = *patch.Name
+	}
+	if patch.Category != nil {
+		if *patch.Category == "" {
+			return nil, fmt.Errorf("%w: category cannot be empty", ErrInvalidProductUpdate)
+		}
+		set["category"] = *patch.Category
+	}
+	if patch.Price != nil {
+		if *patch.Price <= 0 {
+			return nil, fmt.Errorf("%w: price must be greater than 0", ErrInvalidProductUpdate)
+		}
+		set["price"] = *patch.Price
+	}
+	if patch.Stock != nil {
+		if *patch.Stock < 0 {
+			return nil, fmt.Errorf("%w: stock cannot be negative", ErrInvalidProductUpdate)
+		}
+		set["stock"] = *patch.Stock
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("%w: no fields to update", ErrInvalidProductUpdate)
+	}
+	return ps.models.Products.UpdateProduct(productID, set)
+}
 
+func (ps *ProductsService) ArchiveProduct(productID string) (*types.Product, error) {
+	return ps.models.Products.ArchiveProduct(productID)
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"foodie-service/models"
+	"foodie-service/types"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// maxAddresses caps the size of an address book
+const maxAddresses = 20
+
+var (
+	ErrInvalidProfile  = errors.New("invalid profile")
+	ErrInvalidAddress  = errors.New("invalid address")
+	ErrAddressNotFound = errors.New("address not found")
+	ErrAddressConflict = errors.New("address book was changed concurrently, retry the request")
+)
+
+var phoneRegex = regexp.MustCompile(`^\+?[0-9 ()-]{6,20}$`)
+
+type UsersService struct {
+	models *models.BaseModel
+}
+
+func NewUsersService(models *models.BaseModel) *UsersService {
+	return &UsersService{
+		models: models,
+	}
+}
+
+func (us *UsersService) GetProfile(subject string) (*types.Profile, error) {
+	user, err := userForSubject(us.models, subject)
+	if err != nil {
+		return nil, err
+	}
+	return user.ToProfile(), nil
+}
+
+func (us *UsersService) UpdateProfile(subject string, request *types.UpdateProfileRequest) (*types.Profile, error) {
+	user, err := userForSubject(us.models, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{}
+	unset := []string{}
+	if request.Name != nil {
+		name := strings.TrimSpace(*request.Name)
+		if len(name) > 100 {
+			return nil, fmt.Errorf("%w: name must be at most 100 characters", ErrInvalidProfile)
+		}
+		if name == "" {
+			unset = append(unset, "name")
+		} else {
+			set["name"] = name
+		}
+	}
+	if request.Phone != nil {
+		phone := strings.TrimSpace(*request.Phone)
+		if phone == "" {
+			unset = append(unset, "phone")
+		} else if !phoneRegex.MatchString(phone) {
+			return nil, fmt.Errorf("%w: phone must contain only digits, spaces, brackets, dashes and a leading +", ErrInvalidProfile)
+		} else {
+			set["phone"] = phone
+		}
+	}
+
+	user, err = us.models.Auth.UpdateUserProfile(user.UserID, set, unset...)
+	if err != nil {
+		return nil, err
+	}
+	return user.ToProfile(), nil
+}
+
+func toAddress(address models.Address) types.Address {
+	return types.Address(address)
+}
+
+func toAddresses(addresses []models.Address) []types.Address {
+	result := make([]types.Address, len(addresses))
+	for i, address := range addresses {
+		result[i] = toAddress(address)
+	}
+	return result
+}
+
+func (us *UsersService) GetAddresses(subject string) ([]types.Address, error) {
+	user, err := userForSubject(us.models, subject)
+	if err != nil {
+		return nil, err
+	}
+	return toAddresses(user.Addresses), nil
+}
+
+func (us *UsersService) GetAddress(subject string, addressID string) (*types.Address, error) {
+	user, err := userForSubject(us.models, subject)
+	if err != nil {
+		return nil, err
+	}
+	address := user.FindAddress(addressID)
+	if address == nil {
+		return nil, ErrAddressNotFound
+	}
+	result := toAddress(*address)
+	return &result, nil
+}
+
+// updateAddresses applies change to the user's address book and saves it,
+// retrying when another request changed the user in between. change returns
+// the address the request was about.
+func (us *UsersService) updateAddresses(subject string, change func(addresses []models.Address) ([]models.Address, string, error)) (*types.Address, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		user, err := userForSubject(us.models, subject)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses := append([]models.Address{}, user.Addresses...)
+		addresses, addressID, err := change(addresses)
+		if err != nil {
+			return nil, err
+		}
+		ensureDefaultAddress(addresses)
+
+		updated, err := us.models.Auth.ReplaceUserAddresses(user.UserID, addresses, user.UpdatedAt)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if address := updated.FindAddress(addressID); address != nil {
+			result := toAddress(*address)
+			return &result, nil
+		}
+		return nil, nil
+	}
+	return nil, ErrAddressConflict
+}
+
+// ensureDefaultAddress makes the first address the default when none is
+func ensureDefaultAddress(addresses []models.Address) {
+	if len(addresses) == 0 {
+		return
+	}
+	for _, address := range addresses {
+		if address.IsDefault {
+			return
+		}
+	}
+	addresses[0].IsDefault = true
+}
+
+// makeDefaultAddress clears the default flag on every address but index
+func makeDefaultAddress(addresses []models.Address, index int) {
+	for i := range addresses {
+		addresses[i].IsDefault = i == index
+	}
+}
+
+func validateAddress(address models.Address) error {
+	required := []struct{ field, value string }{
+		{"label", address.Label},
+		{"line1", address.Line1},
+		{"city", address.City},
+		{"postalCode", address.PostalCode},
+		{"country", address.Country},
+	}
+	for _, r := range required {
+		if strings.TrimSpace(r.value) == "" {
+			return fmt.Errorf("%w: %s is required", ErrInvalidAddress, r.field)
+		}
+	}
+	if address.Phone != "" && !phoneRegex.MatchString(address.Phone) {
+		return fmt.Errorf("%w: phone must contain only digits, spaces, brackets, dashes and a leading +", ErrInvalidAddress)
+	}
+	return nil
+}
+
+func (us *UsersService) AddAddress(subject string, request *types.AddressRequest) (*types.Address, error) {
+	address := models.Address{
+		AddressID:    uuid.New().String(),
+		Label:        request.Label,
+		Recipient:    request.Recipient,
+		Line1:        request.Line1,
+		Line2:        request.Line2,
+		City:         request.City,
+		State:        request.State,
+		PostalCode:   request.PostalCode,
+		Country:      request.Country,
+		Phone:        request.Phone,
+		Instructions: request.Instructions,
+	}
+	if err := validateAddress(address); err != nil {
+		return nil, err
+	}
+
+	return us.updateAddresses(subject, func(addresses []models.Address) ([]models.Address, string, error) {
+		if len(addresses) >= maxAddresses {
+			return nil, "", fmt.Errorf("%w: at most %d addresses can be saved", ErrInvalidAddress, maxAddresses)
+		}
+		addresses = append(addresses, address)
+		if request.IsDefault {
+			makeDefaultAddress(addresses, len(addresses)-1)
+		}
+		return addresses, address.AddressID, nil
+	})
+}
+
+// UpdateAddress changes the fields present in request. Setting isDefault makes
+// the address the default; to change the default, set it on another address.
+func (us *UsersService) UpdateAddress(subject string, addressID string, request *types.PatchAddressRequest) (*types.Address, error) {
+	return us.updateAddresses(subject, func(addresses []models.Address) ([]models.Address, string, error) {
+		index := -1
+		for i := range addresses {
+			if addresses[i].AddressID == addressID {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, "", ErrAddressNotFound
+		}
+
+		address := addresses[index]
+		fields := []struct {
+			value  *string
+			target *string
+		}{
+			{request.Label, &address.Label},
+			{request.Recipient, &address.Recipient},
+			{request.Line1, &address.Line1},
+			{request.Line2, &address.Line2},
+			{request.City, &address.City},
+			{request.State, &address.State},
+			{request.PostalCode, &address.PostalCode},
+			{request.Country, &address.Country},
+			{request.Phone, &address.Phone},
+			{request.Instructions, &address.Instructions},
+		}
+		for _, field := range fields {
+			if field.value != nil {
+				*field.target = *field.value
+			}
+		}
+		if err := validateAddress(address); err != nil {
+			return nil, "", err
+		}
+
+		addresses[index] = address
+		if request.IsDefault != nil && *request.IsDefault {
+			makeDefaultAddress(addresses, index)
+		}
+		return addresses, addressID, nil
+	})
+}
+
+// DeleteAddress removes an address. When it was the default, the first
+// remaining address becomes the default.
+func (us *UsersService) DeleteAddress(subject string, addressID string) error {
+	_, err := us.updateAddresses(subject, func(addresses []models.Address) ([]models.Address, string, error) {
+		for i := range addresses {
+			if addresses[i].AddressID == addressID {
+				return append(addresses[:i], addresses[i+1:]...), "", nil
+			}
+		}
+		return nil, "", ErrAddressNotFound
+	})
+	return err
+}
@@ -6,7 +6,27 @@ type SignInRequest struct {
 }
 
 type SignInResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	// ExpiresIn is the access token lifetime in seconds
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 type SignupRequest struct {
@@ -18,3 +38,36 @@ type SignupResponse struct {
 	UserID string `json:"userId"`
 }
 
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleStaff    Role = "staff"
+	RoleAdmin    Role = "admin"
+)
+
+func (r Role) IsValid() bool {
+	return r == RoleCustomer || r == RoleStaff || r == RoleAdmin
+}
+
+type UpdateUserRoleRequest struct {
+	Role Role `json:"role" validate:"required"`
+}
+
+// JWK is a public key in JSON Web Key format. RSA keys use N and E, Ed25519
+// keys use Crv and X, and EC keys use Crv, X and Y.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
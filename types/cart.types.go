@@ -0,0 +1,38 @@
+package types
+
+import "time"
+
+type CartItemRequest struct {
+	ProductID string `json:"productId" validate:"required"`
+	Quantity  int    `json:"quantity" validate:"required"`
+}
+
+type ApplyCouponRequest struct {
+	CouponCode string `json:"couponCode" validate:"required"`
+}
+
+type CartItem struct {
+	ProductID string   `json:"productId"`
+	Quantity  int      `json:"quantity"`
+	Product   *Product `json:"product,omitempty"`
+	LineTotal float64  `json:"lineTotal"`
+	// Available is false when the product has been removed from the catalogue
+	Available bool `json:"available"`
+}
+
+type CartDetails struct {
+	Items      []CartItem `json:"items"`
+	CouponCode string     `json:"couponCode"`
+	// CouponError explains why the applied coupon is not being honoured
+	CouponError     string                `json:"couponError,omitempty"`
+	CouponRejection CouponRejectionReason `json:"couponRejection,omitempty"`
+	TotalPrice      float64               `json:"totalPrice"`
+	Discount        float64               `json:"discount"`
+	FinalPrice      float64               `json:"finalPrice"`
+	UpdatedAt       time.Time             `json:"updatedAt"`
+}
+
+// CheckoutRequest optionally picks the delivery address for the order
+type CheckoutRequest struct {
+	AddressID string `json:"addressId"`
+}
@@ -0,0 +1,97 @@
+package types
+
+import "time"
+
+type CouponType string
+
+const (
+	// CouponTypePercentage takes Value percent off the eligible items
+	CouponTypePercentage CouponType = "percentage"
+	// CouponTypeFixed takes Value off the eligible items, never more than
+	// they cost
+	CouponTypeFixed CouponType = "fixed"
+)
+
+// CouponRejectionReason says why a coupon cannot be used on an order
+type CouponRejectionReason string
+
+const (
+	CouponNotFound          CouponRejectionReason = "not_found"
+	CouponInactive          CouponRejectionReason = "inactive"
+	CouponNotStarted        CouponRejectionReason = "not_started"
+	CouponExpired           CouponRejectionReason = "expired"
+	CouponMinOrderNotMet    CouponRejectionReason = "min_order_not_met"
+	CouponNotApplicable     CouponRejectionReason = "not_applicable"
+	CouponUsageLimitReached CouponRejectionReason = "usage_limit_reached"
+	CouponUserLimitReached  CouponRejectionReason = "user_limit_reached"
+)
+
+// CouponRequest sets the rules of a coupon. Zero limits mean no limit and
+// empty categories and product IDs make the coupon apply to every item.
+type CouponRequest struct {
+	Type                  CouponType `json:"type" validate:"required"`
+	Value                 float64    `json:"value" validate:"required"`
+	MaxDiscount           float64    `json:"maxDiscount"`
+	MinOrderValue         float64    `json:"minOrderValue"`
+	StartsAt              *time.Time `json:"startsAt"`
+	EndsAt                *time.Time `json:"endsAt"`
+	MaxRedemptions        int        `json:"maxRedemptions"`
+	MaxRedemptionsPerUser int        `json:"maxRedemptionsPerUser"`
+	Categories            []string   `json:"categories"`
+	ProductIDs            []string   `json:"productIds"`
+	Active                *bool      `json:"active"`
+}
+
+// PatchCouponRequest changes only the fields that are present. Setting a
+// limit to 0 removes it.
+type PatchCouponRequest struct {
+	Type                  *CouponType `json:"type"`
+	Value                 *float64    `json:"value"`
+	MaxDiscount           *float64    `json:"maxDiscount"`
+	MinOrderValue         *float64    `json:"minOrderValue"`
+	StartsAt              *time.Time  `json:"startsAt"`
+	EndsAt                *time.Time  `json:"endsAt"`
+	MaxRedemptions        *int        `json:"maxRedemptions"`
+	MaxRedemptionsPerUser *int        `json:"maxRedemptionsPerUser"`
+	Categories            *[]string   `json:"categories"`
+	ProductIDs            *[]string   `json:"productIds"`
+	Active                *bool       `json:"active"`
+}
+
+// GenerateCouponsRequest mints Count coupons sharing the same rules, each
+// with Prefix followed by Length random characters
+type GenerateCouponsRequest struct {
+	CouponRequest
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count" validate:"required"`
+	Length int    `json:"length"`
+}
+
+// CouponTypeLegacy filters listings to codes from the gzip import, which have
+// no type
+const CouponTypeLegacy CouponType = "legacy"
+
+// CouponQuery filters an admin listing of coupons. Pages are ordered by code
+// and After is the last code of the previous page.
+type CouponQuery struct {
+	Prefix string
+	Type   CouponType
+	Active *bool
+	After  string
+	Limit  int
+}
+
+type CouponPage struct {
+	Limit int `json:"limit"`
+	// NextAfter is passed as after to fetch the next page; it is null on
+	// the last page
+	NextAfter *string `json:"nextAfter"`
+}
+
+// CouponCheck says whether a code can be used on a cart, without revealing
+// anything else about the coupon
+type CouponCheck struct {
+	Code       string                `json:"code"`
+	Applicable bool                  `json:"applicable"`
+	Reason     CouponRejectionReason `json:"reason,omitempty"`
+}
@@ -2,24 +2,111 @@ package types
 
 import "time"
 
+type OrderStatus string
+
+const (
+	OrderStatusPlaced         OrderStatus = "placed"
+	OrderStatusConfirmed      OrderStatus = "confirmed"
+	OrderStatusPreparing      OrderStatus = "preparing"
+	OrderStatusOutForDelivery OrderStatus = "out_for_delivery"
+	OrderStatusDelivered      OrderStatus = "delivered"
+	OrderStatusCancelled      OrderStatus = "cancelled"
+	OrderStatusRefunded       OrderStatus = "refunded"
+)
+
 type Order struct {
 	ProductID string `json:"productId" validate:"required"`
 	Quantity  int    `json:"quantity" validate:"required"`
 }
 
+// LineItem is an ordered product together with a snapshot of the catalogue
+// entry taken when the order was placed, so later price changes or deletions
+// do not alter order history
+type LineItem struct {
+	ProductID string  `json:"productId"`
+	Quantity  int     `json:"quantity"`
+	Name      string  `json:"name"`
+	Category  string  `json:"category"`
+	UnitPrice float64 `json:"unitPrice"`
+	LineTotal float64 `json:"lineTotal"`
+	Thumbnail string  `json:"thumbnail"`
+	// StockReserved is set when the product was stock-tracked when the order
+	// was placed, so cancelling the order hands its units back
+	StockReserved bool `json:"-" bson:"stockReserved,omitempty"`
+}
+
+// HasSnapshot reports whether the item was stored with its catalogue snapshot.
+// Orders placed before snapshots existed only carry productId and quantity.
+func (li *LineItem) HasSnapshot() bool {
+	return li.Name != "" || li.UnitPrice != 0
+}
+
+// BulkOrdersRequest places an order. AddressID picks the delivery address
+// from the user's address book; without it the default address is used.
 type BulkOrdersRequest struct {
 	Items      []Order `json:"items" validate:"required"`
 	CouponCode string  `json:"couponCode"`
+	AddressID  string  `json:"addressId,omitempty"`
+}
+
+type OutOfStockItem struct {
+	ProductID string `json:"productId"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+type StatusChange struct {
+	From      OrderStatus `json:"from,omitempty"`
+	To        OrderStatus `json:"to"`
+	ChangedBy string      `json:"changedBy"`
+	Note      string      `json:"note,omitempty"`
+	ChangedAt time.Time   `json:"changedAt"`
+}
+
+type UpdateOrderStatusRequest struct {
+	Status OrderStatus `json:"status" validate:"required"`
+	Note   string      `json:"note"`
+}
+
+type CancelOrderRequest struct {
+	Reason string `json:"reason" validate:"required"`
+}
+
+type Cancellation struct {
+	Reason      string    `json:"reason"`
+	CancelledBy string    `json:"cancelledBy"`
+	CancelledAt time.Time `json:"cancelledAt"`
+}
+
+type RefundStatus string
+
+const (
+	RefundStatusPending   RefundStatus = "pending"
+	RefundStatusCompleted RefundStatus = "completed"
+)
+
+type Refund struct {
+	Amount         float64      `json:"amount"`
+	CouponCode     string       `json:"couponCode,omitempty"`
+	CouponReleased bool         `json:"couponReleased"`
+	Status         RefundStatus `json:"status"`
+	CreatedAt      time.Time    `json:"createdAt"`
+	CompletedAt    *time.Time   `json:"completedAt,omitempty"`
 }
 
 type PurchaseDetails struct {
-	OrderID    string    `json:"orderId"`
-	Items      []Order   `json:"items"`
-	Products   []Product `json:"products"`
-	TotalPrice float64      `json:"totalPrice"`
-	Discount   float64       `json:"discount"`
-	FinalPrice float64       `json:"finalPrice"`
-	CouponCode string    `json:"couponCode"`
-	CreatedAt  time.Time `json:"createdAt"`
-	UpdatedAt  time.Time `json:"updatedAt"`
+	OrderID         string         `json:"orderId"`
+	Items           []LineItem     `json:"items"`
+	Products        []Product      `json:"products"`
+	TotalPrice      float64        `json:"totalPrice"`
+	Discount        float64        `json:"discount"`
+	FinalPrice      float64        `json:"finalPrice"`
+	CouponCode      string         `json:"couponCode"`
+	DeliveryAddress *Address       `json:"deliveryAddress,omitempty"`
+	Status          OrderStatus    `json:"status"`
+	StatusHistory   []StatusChange `json:"statusHistory"`
+	Cancellation    *Cancellation  `json:"cancellation,omitempty"`
+	Refund          *Refund        `json:"refund,omitempty"`
+	CreatedAt       time.Time      `json:"createdAt"`
+	UpdatedAt       time.Time      `json:"updatedAt"`
 }
@@ -8,13 +8,61 @@ type Image struct {
 }
 
 type Product struct {
-	ProductID  string    `json:"productId" validate:"required"`
-	Image      Image     `json:"image" validate:"required"`
-	Name       string    `json:"name" validate:"required"`
-	Category   string    `json:"category" validate:"required"`
-	Price      float64   `json:"price" validate:"required"`
+	ProductID string  `json:"productId" validate:"required"`
+	Image     Image   `json:"image" validate:"required"`
+	Name      string  `json:"name" validate:"required"`
+	Category  string  `json:"category" validate:"required"`
+	Price     float64 `json:"price" validate:"required"`
+	Stock     *int    `json:"stock,omitempty"`
+	Archived  bool    `json:"archived,omitempty"`
 }
 
 type BulkProductsRequest struct {
 	Products []Product `json:"products" validate:"required"`
-}
\ No newline at end of file
+}
+
+// UpdateProductRequest replaces every editable field of a product. Leaving
+// stock out stops tracking stock for the product.
+type UpdateProductRequest struct {
+	Image    Image   `json:"image" validate:"required"`
+	Name     string  `json:"name" validate:"required"`
+	Category string  `json:"category" validate:"required"`
+	Price    float64 `json:"price" validate:"required"`
+	Stock    *int    `json:"stock"`
+}
+
+// PatchProductRequest changes only the fields that are present
+type PatchProductRequest struct {
+	Image    *Image   `json:"image"`
+	Name     *string  `json:"name"`
+	Category *string  `json:"category"`
+	Price    *float64 `json:"price"`
+	Stock    *int     `json:"stock"`
+}
+
+const (
+	ProductSortPriceAsc  = "price"
+	ProductSortPriceDesc = "-price"
+	ProductSortNameAsc   = "name"
+	ProductSortNameDesc  = "-name"
+	ProductSortNewest    = "newest"
+)
+
+type ProductQuery struct {
+	// IncludeArchived also returns products that have been retired
+	IncludeArchived bool
+	Category        string
+	MinPrice        *float64
+	MaxPrice        *float64
+	Search          string
+	Sort            string
+	Limit           int
+	Offset          int
+}
+
+type ProductPage struct {
+	Total      int64 `json:"total"`
+	Limit      int   `json:"limit"`
+	Offset     int   `json:"offset"`
+	NextOffset *int  `json:"nextOffset"`
+}
@@ -0,0 +1,66 @@
+package types
+
+import "time"
+
+type Profile struct {
+	UserID    string    `json:"userId"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Phone     string    `json:"phone"`
+	Role      Role      `json:"role"`
+	Verified  bool      `json:"verified"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UpdateProfileRequest changes only the fields that are present. An empty
+// string clears a field.
+type UpdateProfileRequest struct {
+	Name  *string `json:"name"`
+	Phone *string `json:"phone"`
+}
+
+// Address is a delivery address from a user's address book. Orders keep a copy
+// of the address they were placed with.
+type Address struct {
+	AddressID    string `json:"addressId"`
+	Label        string `json:"label"`
+	Recipient    string `json:"recipient,omitempty"`
+	Line1        string `json:"line1"`
+	Line2        string `json:"line2,omitempty"`
+	City         string `json:"city"`
+	State        string `json:"state,omitempty"`
+	PostalCode   string `json:"postalCode"`
+	Country      string `json:"country"`
+	Phone        string `json:"phone,omitempty"`
+	Instructions string `json:"instructions,omitempty"`
+	IsDefault    bool   `json:"isDefault"`
+}
+
+type AddressRequest struct {
+	Label        string `json:"label" validate:"required"`
+	Recipient    string `json:"recipient"`
+	Line1        string `json:"line1" validate:"required"`
+	Line2        string `json:"line2"`
+	City         string `json:"city" validate:"required"`
+	State        string `json:"state"`
+	PostalCode   string `json:"postalCode" validate:"required"`
+	Country      string `json:"country" validate:"required"`
+	Phone        string `json:"phone"`
+	Instructions string `json:"instructions"`
+	IsDefault    bool   `json:"isDefault"`
+}
+
+// PatchAddressRequest changes only the fields that are present
+type PatchAddressRequest struct {
+	Label        *string `json:"label"`
+	Recipient    *string `json:"recipient"`
+	Line1        *string `json:"line1"`
+	Line2        *string `json:"line2"`
+	City         *string `json:"city"`
+	State        *string `json:"state"`
+	PostalCode   *string `json:"postalCode"`
+	Country      *string `json:"country"`
+	Phone        *string `json:"phone"`
+	Instructions *string `json:"instructions"`
+	IsDefault    *bool   `json:"isDefault"`
+}
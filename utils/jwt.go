@@ -1,56 +1,170 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	"foodie-service/config"
+	"foodie-service/types"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
+// RevocationChecker reports whether an access token has been revoked before
+// its expiry, for example on logout
+type RevocationChecker interface {
+	IsTokenRevoked(jti string) (bool, error)
+}
+
+var revocationChecker RevocationChecker
+
+// SetRevocationChecker makes ValidateToken reject tokens that rc reports as
+// revoked
+func SetRevocationChecker(rc RevocationChecker) {
+	revocationChecker = rc
+}
+
+// SubjectResolver finds the userId of the user with an email address. Tokens
+// issued before subjects were uuids carry the email address instead.
+type SubjectResolver interface {
+	UserIDForEmail(email string) (string, error)
+}
+
+var subjectResolver SubjectResolver
+
+// SetSubjectResolver makes ValidateToken replace email subjects with the
+// user's uuid, so handlers only ever see uuids
+func SetSubjectResolver(sr SubjectResolver) {
+	subjectResolver = sr
+}
+
 type Claims struct {
-	UserID string `json:"user_id"`
+	UserID string     `json:"user_id"`
+	Role   types.Role `json:"role"`
 	jwt.RegisteredClaims
 }
 
+// tokenFromRequest reads the access token from the Authorization header,
+// falling back to the legacy header when that is enabled
+func tokenFromRequest(c *fiber.Ctx) (string, error) {
+	if authorization := c.Get(fiber.HeaderAuthorization); authorization != "" {
+		scheme, token, _ := strings.Cut(authorization, " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.New("Authorization header must be in the form: Bearer <token>")
+		}
+		return token, nil
+	}
+
+	if header := config.GetConfig().LegacyAPIKeyHeader; header != "" {
+		if apiKey := c.Get(header); apiKey != "" {
+			return strings.TrimPrefix(apiKey, "Bearer "), nil
+		}
+	}
+	return "", nil
+}
+
+// unauthorized responds with 401 and a WWW-Authenticate challenge. errorCode
+// is the RFC 6750 error code, left out when no token was sent.
+func unauthorized(errorType, errorCode, errorMessage string, c *fiber.Ctx) error {
+	challenge := `Bearer realm="foodie-service"`
+	if errorCode != "" {
+		challenge += fmt.Sprintf(`, error="%s", error_description=%q`, errorCode, errorMessage)
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, challenge)
+	return ErrorHandler(errorType, errorMessage, fiber.StatusUnauthorized, c)
+}
+
 func ValidateToken() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		apiKey := c.Get("api-key")
-		if apiKey == "" {
-			return ErrorHandler("API key is required", "API key is required", fiber.StatusUnauthorized, c)
+		tokenString, err := tokenFromRequest(c)
+		if err != nil {
+			return unauthorized("Invalid authorization header", "invalid_request", err.Error(), c)
+		}
+		if tokenString == "" {
+			return unauthorized("Token is required", "", "A bearer token is required in the Authorization header", c)
 		}
 
-		tokenString := strings.TrimPrefix(apiKey, "Bearer ")
-
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.GetConfig().JWTSecret), nil
-		})
+		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, tokenKeyFunc)
 
 		if err != nil {
-			return ErrorHandler("Invalid token", err.Error(), fiber.StatusUnauthorized, c)
+			return unauthorized("Invalid token", "invalid_token", err.Error(), c)
 		}
 
 		claims, ok := token.Claims.(*Claims)
 		if !ok || !token.Valid {
-			return ErrorHandler("Invalid token claims", "Invalid token claims", fiber.StatusUnauthorized, c)
+			return unauthorized("Invalid token claims", "invalid_token", "Invalid token claims", c)
 		}
 
-		c.Locals("userID", claims.UserID)
+		if revocationChecker != nil {
+			revoked, err := revocationChecker.IsTokenRevoked(claims.ID)
+			if err != nil {
+				return ErrorHandler("Error validating token", err.Error(), fiber.StatusInternalServerError, c)
+			}
+			if revoked {
+				return unauthorized("Invalid token", "invalid_token", "token has been revoked", c)
+			}
+		}
+
+		role := claims.Role
+		if role == "" {
+			role = types.RoleCustomer
+		}
+
+		userID := claims.UserID
+		if strings.Contains(userID, "@") && subjectResolver != nil {
+			resolved, err := subjectResolver.UserIDForEmail(userID)
+			if err != nil {
+				return ErrorHandler("Error validating token", err.Error(), fiber.StatusInternalServerError, c)
+			}
+			if resolved == "" {
+				return unauthorized("Invalid token", "invalid_token", "the user of this token no longer exists", c)
+			}
+			userID = resolved
+		}
+
+		c.Locals("userID", userID)
+		c.Locals("role", role)
+		c.Locals("tokenID", claims.ID)
+		if claims.ExpiresAt != nil {
+			c.Locals("tokenExpiresAt", claims.ExpiresAt.Time)
+		}
 
 		return c.Next()
 	}
 }
 
-func GenerateToken(userID string) (string, error) {
+// RequireRole only lets requests through when the token's role is one of
+// roles. It must run after ValidateToken.
+func RequireRole(roles ...types.Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, _ := c.Locals("role").(types.Role)
+		for _, allowed := range roles {
+			if role == allowed {
+				return c.Next()
+			}
+		}
+		return ErrorHandler("Forbidden", "You do not have permission to perform this action", fiber.StatusForbidden, c)
+	}
+}
+
+// GenerateToken issues a short-lived access token. Each token carries a unique
+// jti so it can be revoked individually.
+func GenerateToken(userID string, role types.Role) (string, error) {
+	now := time.Now()
 	claims := &Claims{
 		UserID: userID,
+		Role:   role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
+			ID:        uuid.New().String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(config.GetConfig().AccessTokenTTL)),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(config.GetConfig().JWTSecret))
+	tokenString, err := signToken(claims)
 	if err != nil {
 		return "", err
 	}
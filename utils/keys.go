@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"foodie-service/config"
+	"foodie-service/types"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// verificationKey is a public key tokens may be signed with, identified by the
+// kid in the token header
+type verificationKey struct {
+	id     string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+// signingKey is the private key new tokens are signed with
+type signingKey struct {
+	verificationKey
+	private crypto.Signer
+}
+
+var (
+	currentSigningKey *signingKey
+	verificationKeys  map[string]*verificationKey
+)
+
+// LoadSigningKeys reads the PEM keys named in the configuration. When no
+// signing key is configured tokens keep being signed with JWT_SECRET (HS256).
+// Verification keys let tokens signed by a previous key stay valid while keys
+// are rotated.
+func LoadSigningKeys() error {
+	cfg := config.GetConfig()
+	if cfg.JWTSigningKeyPath == "" {
+		currentSigningKey = nil
+		verificationKeys = nil
+		return nil
+	}
+
+	key, err := readPrivateKey(cfg.JWTSigningKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load signing key: %w", err)
+	}
+	signer := &signingKey{private: key}
+	signer.public = key.Public()
+	if signer.method, err = signingMethodFor(signer.public); err != nil {
+		return err
+	}
+	signer.id = cfg.JWTKeyID
+	if signer.id == "" {
+		if signer.id, err = keyThumbprint(signer.public); err != nil {
+			return err
+		}
+	}
+
+	keys := map[string]*verificationKey{signer.id: &signer.verificationKey}
+	for _, entry := range cfg.JWTVerificationKeys {
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || path == "" {
+			return fmt.Errorf("verification key %q must be in the form kid=path", entry)
+		}
+		public, err := readPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("failed to load verification key %s: %w", kid, err)
+		}
+		method, err := signingMethodFor(public)
+		if err != nil {
+			return err
+		}
+		keys[kid] = &verificationKey{id: kid, method: method, public: public}
+	}
+
+	currentSigningKey = signer
+	verificationKeys = keys
+	return nil
+}
+
+// tokenKeyFunc picks the key a token is verified with: the configured public
+// key matching its kid, or JWT_SECRET when no asymmetric keys are configured
+func tokenKeyFunc(token *jwt.Token) (interface{}, error) {
+	if currentSigningKey == nil {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return []byte(config.GetConfig().JWTSecret), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := verificationKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+func signToken(claims jwt.Claims) (string, error) {
+	if currentSigningKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.GetConfig().JWTSecret))
+	}
+
+	token := jwt.NewWithClaims(currentSigningKey.method, claims)
+	token.Header["kid"] = currentSigningKey.id
+	return token.SignedString(currentSigningKey.private)
+}
+
+// JWKS returns the public keys tokens may be verified with. It is empty when
+// tokens are signed with the shared secret.
+func JWKS() types.JWKS {
+	set := types.JWKS{Keys: []types.JWK{}}
+	for _, key := range verificationKeys {
+		jwk := types.JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// ParsePublicJWK converts a JSON Web Key published by another issuer into a
+// public key that tokens can be verified with
+func ParsePublicJWK(jwk types.JWK) (crypto.PublicKey, error) {
+	decode := func(value string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return key, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Ed25519 key has the wrong length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+func signingMethodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T, use an RSA or Ed25519 key", public)
+}
+
+// keyThumbprint derives a stable key id from the public key
+func keyThumbprint(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// readPublicKey accepts a public key or a private key, from which the public
+// half is taken
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := readPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public(), nil
+}